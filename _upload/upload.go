@@ -10,7 +10,9 @@ import (
 // const baseURL = "http://localhost:8080"
 const baseURL = "https://comp3007-f25.scs.carleton.ca"
 
-const requestURL = "/upload/" + "fioD0aiZeer6ahzoovohs7Asheishepaefei8ue1taecuzohph8eeyaiphiel3oh"
+// Uploads are authenticated with a personal API token that has the upload
+// scope. Create one under "API Tokens" in the site's user menu.
+const requestURL = "/upload/"
 
 func main() {
 	// Check if we have the correct number of arguments
@@ -22,6 +24,12 @@ func main() {
 
 	filename := os.Args[1]
 
+	token := os.Getenv("UPLOAD_TOKEN")
+	if token == "" {
+		fmt.Fprintf(os.Stderr, "Set UPLOAD_TOKEN to a personal API token with the upload scope\n")
+		os.Exit(1)
+	}
+
 	// Check if file exists and can be opened
 	file, err := os.Open(filename)
 	if err != nil {
@@ -51,6 +59,7 @@ func main() {
 
 	// Set appropriate headers
 	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.ContentLength = fileInfo.Size()
 
 	// Optional: Set additional headers that might be useful
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API token scopes. A session cookie carries no scopes and may do anything
+// its user may; a token may only do what its scopes allow.
+const (
+	ScopeRead   = "read"   // view course content
+	ScopeUpload = "upload" // PUT files to /upload
+	ScopeAdmin  = "admin"  // use admin routes, if the owner is an admin
+)
+
+var allScopes = []string{ScopeRead, ScopeUpload, ScopeAdmin}
+
+const apiTokenPrefix = "pat_"
+
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+}
+
+type APITokensPage struct {
+	Error    string
+	Success  string
+	NewToken string // shown once, right after creation
+	Tokens   []*APIToken
+	Scopes   []string // scopes the user may grant
+	User     *AuthClaims
+	Nav      []NavItem
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	return containsString(t.Scopes, scope)
+}
+
+// CreateAPIToken issues a new token for the user and returns it in plain
+// text. Only its SHA-256 hash is stored, so it can't be shown again.
+func (am *AuthManager) CreateAPIToken(userID int, name string, scopes []string, expiresAt *time.Time) (string, error) {
+	for _, scope := range scopes {
+		if !containsString(allScopes, scope) {
+			return "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	raw, err := generateSecureToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate API token: %w", err)
+	}
+	token := apiTokenPrefix + raw
+
+	_, err = am.db.Exec(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, userID, name, hashToken(token), strings.Join(scopes, ","), expiresAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to store API token: %w", err)
+	}
+	return token, nil
+}
+
+func (am *AuthManager) GetAPITokens(userID int) ([]*APIToken, error) {
+	rows, err := am.db.Query(`
+		SELECT id, user_id, name, scopes, created_at, last_used_at, expires_at
+		FROM api_tokens WHERE user_id = ? AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (am *AuthManager) RevokeAPIToken(userID, tokenID int) error {
+	result, err := am.db.Exec(`
+		UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`, tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API token: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("API token not found")
+	}
+	return nil
+}
+
+// ValidateAPIToken looks up a bearer token and returns claims for its
+// owner, limited to the token's scopes.
+func (am *AuthManager) ValidateAPIToken(token string) (*AuthClaims, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, fmt.Errorf("invalid API token")
+	}
+
+	row := am.db.QueryRow(`
+		SELECT id, user_id, name, scopes, created_at, last_used_at, expires_at
+		FROM api_tokens WHERE token_hash = ? AND revoked_at IS NULL
+	`, hashToken(token))
+	apiToken, err := scanAPIToken(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("invalid API token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if apiToken.ExpiresAt != nil && time.Now().After(*apiToken.ExpiresAt) {
+		return nil, fmt.Errorf("API token expired")
+	}
+
+	user, err := am.GetUserByID(apiToken.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Disabled {
+		return nil, fmt.Errorf("invalid API token")
+	}
+
+	if _, err := am.db.Exec(`UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?`, apiToken.ID); err != nil {
+		return nil, err
+	}
+
+	return &AuthClaims{
+		UserID:        user.ID,
+		Email:         user.Email,
+		IsAdmin:       user.IsAdmin && apiToken.HasScope(ScopeAdmin),
+		Scopes:        apiToken.Scopes,
+		Name:          user.Name,
+		PreferredName: user.PreferredName,
+		Pronouns:      user.Pronouns,
+	}, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	token := &APIToken{Scopes: []string{}}
+	var scopes string
+	var lastUsed, expires sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &scopes, &token.CreatedAt, &lastUsed, &expires)
+	if err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		token.Scopes = strings.Split(scopes, ",")
+	}
+	if lastUsed.Valid {
+		token.LastUsedAt = &lastUsed.Time
+	}
+	if expires.Valid {
+		token.ExpiresAt = &expires.Time
+	}
+	return token, nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// Settings page where users create and revoke their API tokens
+func handleAPITokens(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	if userClaims == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	// Tokens can't be used to mint more tokens
+	if userClaims.Scopes != nil {
+		http.Error(w, "Access denied: sign in to manage API tokens", http.StatusForbidden)
+		return
+	}
+
+	page := APITokensPage{User: userClaims, Nav: config.navItems, Scopes: []string{ScopeRead, ScopeUpload}}
+	if userClaims.IsAdmin {
+		page.Scopes = allScopes
+	}
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			scopes := r.Form["scopes"]
+			if name == "" {
+				page.Error = "Token name is required"
+				break
+			}
+			if len(scopes) == 0 {
+				page.Error = "Select at least one scope"
+				break
+			}
+			if containsString(scopes, ScopeAdmin) {
+				if !userClaims.IsAdmin {
+					page.Error = "Only administrators can create admin tokens"
+					break
+				}
+				// Admin tokens skip the second factor, so minting one needs it
+				if config.RequireAdmin2FA && !userClaims.MFA {
+					page.Error = "Sign in with two-factor authentication to create admin tokens"
+					break
+				}
+			}
+
+			var expiresAt *time.Time
+			if days, err := strconv.Atoi(r.FormValue("expires_days")); err == nil && days > 0 {
+				t := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+				expiresAt = &t
+			}
+
+			token, err := authManager.CreateAPIToken(userClaims.UserID, name, scopes, expiresAt)
+			if err != nil {
+				page.Error = Capitalize(err.Error())
+				break
+			}
+			page.NewToken = token
+			authManager.Audit(r, AuditAPIToken, userClaims.Email, fmt.Sprintf("created %q with scopes %s", name, strings.Join(scopes, ", ")))
+			page.Success = fmt.Sprintf("Token %q created. Copy it now; it won't be shown again.", name)
+
+		case "revoke":
+			tokenID, err := strconv.Atoi(r.FormValue("token_id"))
+			if err != nil {
+				http.Error(w, "Invalid token ID", http.StatusBadRequest)
+				return
+			}
+			if err := authManager.RevokeAPIToken(userClaims.UserID, tokenID); err != nil {
+				page.Error = Capitalize(err.Error())
+				break
+			}
+			authManager.Audit(r, AuditAPIToken, userClaims.Email, fmt.Sprintf("revoked token %d", tokenID))
+			page.Success = "Token revoked"
+
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokens, err := authManager.GetAPITokens(userClaims.UserID)
+	if err != nil {
+		panicf("Error getting API tokens: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	page.Tokens = tokens
+
+	if err := config.templates.ExecuteTemplate(w, "api-tokens.html", page); err != nil {
+		panicf("Error executing API tokens template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
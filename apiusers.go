@@ -0,0 +1,492 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The user management API under /api/v1/users takes and returns JSON. It
+// accepts admin-scoped API tokens and browser sessions, with the same
+// permissions as the admin pages: users.view to read, users.manage to make
+// changes. Errors are returned as
+//
+//	{"error": {"code": "not_found", "message": "No user with ID 12"}}
+const (
+	apiUsersDefaultLimit = 50
+	apiUsersMaxLimit     = 500
+	maxAPIRequestSize    = 64 << 10
+)
+
+// Error codes of the API
+const (
+	apiErrUnauthorized = "unauthorized"
+	apiErrForbidden    = "forbidden"
+	apiErrNotFound     = "not_found"
+	apiErrBadRequest   = "bad_request"
+	apiErrConflict     = "conflict"
+	apiErrMethod       = "method_not_allowed"
+	apiErrInternal     = "internal_error"
+)
+
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// APIUserList is a page of users
+type APIUserList struct {
+	Users  []*User `json:"users"`
+	Total  int     `json:"total"` // users matching the filters, on every page
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+}
+
+// APIUserCreate is the body of POST /api/v1/users. The setup email is sent
+// unless send_setup_email is false or users sign in through LDAP.
+type APIUserCreate struct {
+	Email          string `json:"email"`
+	IsAdmin        bool   `json:"is_admin"`
+	Name           string `json:"name"`
+	PreferredName  string `json:"preferred_name"`
+	StudentNumber  string `json:"student_number"`
+	Pronouns       string `json:"pronouns"`
+	Section        string `json:"section"`
+	SendSetupEmail *bool  `json:"send_setup_email"`
+}
+
+// APIUserUpdate is the body of PATCH /api/v1/users/{id}. Only the fields
+// present are changed.
+type APIUserUpdate struct {
+	Email         *string `json:"email"`
+	IsAdmin       *bool   `json:"is_admin"`
+	Disabled      *bool   `json:"disabled"`
+	Name          *string `json:"name"`
+	PreferredName *string `json:"preferred_name"`
+	StudentNumber *string `json:"student_number"`
+	Pronouns      *string `json:"pronouns"`
+	Section       *string `json:"section"`
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("Error writing API response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIJSON(w, status, map[string]APIError{"error": {Code: code, Message: message}})
+}
+
+// RequireAPIPermission is RequirePermission for the API: it answers with
+// JSON errors instead of redirecting to the sign-in page
+func (am *AuthManager) RequireAPIPermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, failure := am.authenticate(r)
+		if failure != nil {
+			if failure.status == http.StatusUnauthorized {
+				if bearerToken(r) != "" {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				}
+				writeAPIError(w, failure.status, apiErrUnauthorized, failure.message)
+			} else if failure.status == http.StatusForbidden {
+				writeAPIError(w, failure.status, apiErrForbidden, failure.message)
+			} else {
+				writeAPIError(w, failure.status, apiErrInternal, failure.message)
+			}
+			return
+		}
+		if !claims.Can(permission) {
+			message := "The " + permission + " permission is required"
+			if claims.Scopes != nil && !claims.HasScope(ScopeAdmin) {
+				message = "The API token needs the admin scope"
+			}
+			writeAPIError(w, http.StatusForbidden, apiErrForbidden, message)
+			return
+		}
+		if am.needsSecondFactor(claims) {
+			writeAPIError(w, http.StatusForbidden, apiErrForbidden, "Sign in with two-factor authentication first")
+			return
+		}
+		next(w, r.WithContext(WithUserContext(r.Context(), claims)))
+	}
+}
+
+// decodeAPIBody reads a JSON request body into v, rejecting unknown fields
+// so that typos don't silently do nothing
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxAPIRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrBadRequest, "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// apiUserWithRoles looks up the user in the URL path, answering with an
+// error if there isn't one
+func apiUserWithRoles(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeAPIError(w, http.StatusBadRequest, apiErrBadRequest, "Invalid user ID")
+		return nil, false
+	}
+	user, err := authManager.GetUserByID(id)
+	if err == nil && user != nil {
+		var roleNames map[int][]string
+		if roleNames, err = authManager.GetUserRoleNames(); err == nil {
+			user.Roles = roleNames[user.ID]
+		}
+	}
+	if err != nil {
+		log.Printf("Error getting user %d: %v", id, err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return nil, false
+	}
+	if user == nil {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, fmt.Sprintf("No user with ID %d", id))
+		return nil, false
+	}
+	return user, true
+}
+
+// GET lists users, POST creates one
+func handleAPIUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		apiListUsers(w, r)
+	case "POST":
+		if !GetUserFromContext(r.Context()).Can(PermUsersManage) {
+			writeAPIError(w, http.StatusForbidden, apiErrForbidden, "The "+PermUsersManage+" permission is required")
+			return
+		}
+		apiCreateUser(w, r)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, apiErrMethod, "Use GET or POST")
+	}
+}
+
+// apiListUsers filters users by the query parameters status (active,
+// pending or disabled), admin (true or false), section, role and q (part of
+// the email or name), then returns the page given by limit and offset.
+// Users are listed oldest first.
+func apiListUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, offset := apiUsersDefaultLimit, 0
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > apiUsersMaxLimit {
+			writeAPIError(w, http.StatusBadRequest, apiErrBadRequest,
+				fmt.Sprintf("limit must be a number from 1 to %d", apiUsersMaxLimit))
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			writeAPIError(w, http.StatusBadRequest, apiErrBadRequest, "offset must be a number of at least 0")
+			return
+		}
+	}
+	status := q.Get("status")
+	if status != "" && status != "active" && status != "pending" && status != "disabled" {
+		writeAPIError(w, http.StatusBadRequest, apiErrBadRequest, "status must be active, pending or disabled")
+		return
+	}
+	admin := q.Get("admin")
+	if admin != "" && admin != "true" && admin != "false" {
+		writeAPIError(w, http.StatusBadRequest, apiErrBadRequest, "admin must be true or false")
+		return
+	}
+	search := strings.ToLower(strings.TrimSpace(q.Get("q")))
+
+	users, err := authManager.usersWithRoles()
+	if err != nil {
+		log.Printf("Error getting users: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+
+	// Oldest first, so that pages don't shift as users are added
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	matching := []*User{}
+	for _, user := range users {
+		switch {
+		case status != "" && userStatus(user) != status,
+			admin != "" && user.IsAdmin != (admin == "true"),
+			q.Has("section") && user.Section != q.Get("section"),
+			q.Has("role") && !containsString(user.Roles, q.Get("role")),
+			search != "" && !strings.Contains(strings.ToLower(user.Email+" "+user.Name+" "+user.PreferredName), search):
+			continue
+		}
+		matching = append(matching, user)
+	}
+
+	list := APIUserList{Users: []*User{}, Total: len(matching), Limit: limit, Offset: offset}
+	if offset < len(matching) {
+		list.Users = matching[offset:min(offset+limit, len(matching))]
+	}
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+func apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	var req APIUserCreate
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !isValidEmail(email) {
+		writeAPIError(w, http.StatusBadRequest, apiErrBadRequest, fmt.Sprintf("Invalid email address: %q", req.Email))
+		return
+	}
+	if req.IsAdmin && !userClaims.IsAdmin {
+		writeAPIError(w, http.StatusForbidden, apiErrForbidden, "Only administrators can create administrators")
+		return
+	}
+	existing, err := authManager.GetUserByEmail(email)
+	if err != nil {
+		log.Printf("Error looking up %s: %v", email, err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Internal Server Error")
+		return
+	}
+	if existing != nil {
+		writeAPIError(w, http.StatusConflict, apiErrConflict, fmt.Sprintf("User with email %s already exists", email))
+		return
+	}
+
+	user, err := authManager.CreateUser(email, req.IsAdmin)
+	if err != nil {
+		log.Printf("Error creating user %s: %v", email, err)
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Failed to create user")
+		return
+	}
+	details := "API"
+	if req.IsAdmin {
+		details = "admin, API"
+	}
+	authManager.Audit(r, AuditUserCreate, email, details)
+
+	// Fill in the rest; the account exists either way
+	profile := Profile{Name: req.Name, PreferredName: req.PreferredName, StudentNumber: req.StudentNumber, Pronouns: req.Pronouns}
+	if profile != (Profile{}) || req.Section != "" {
+		err = authManager.UpdateUserProfile(user.ID, profile)
+		if err == nil && req.Section != "" {
+			err = authManager.SetUserRosterInfo(user.ID, profile.Name, profile.StudentNumber, req.Section)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrBadRequest,
+				fmt.Sprintf("User %s was created, but %s", email, err))
+			return
+		}
+		user.Name, user.PreferredName, user.StudentNumber, user.Pronouns, user.Section =
+			profile.Name, profile.PreferredName, profile.StudentNumber, profile.Pronouns, req.Section
+	}
+
+	if !config.LDAP.Enabled() && (req.SendSetupEmail == nil || *req.SendSetupEmail) {
+		if err := authManager.SendSetupEmail(user, baseURL(r)); err != nil {
+			log.Printf("Error queueing setup email to %s: %v", email, err)
+			writeAPIError(w, http.StatusInternalServerError, apiErrInternal,
+				fmt.Sprintf("User %s was created, but their setup email couldn't be queued", email))
+			return
+		}
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/users/%d", user.ID))
+	writeAPIJSON(w, http.StatusCreated, user)
+}
+
+// GET shows a user, PATCH changes them
+func handleAPIUser(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if user, ok := apiUserWithRoles(w, r); ok {
+			writeAPIJSON(w, http.StatusOK, user)
+		}
+	case "PATCH":
+		if !GetUserFromContext(r.Context()).Can(PermUsersManage) {
+			writeAPIError(w, http.StatusForbidden, apiErrForbidden, "The "+PermUsersManage+" permission is required")
+			return
+		}
+		apiUpdateUser(w, r)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, apiErrMethod, "Use GET or PATCH")
+	}
+}
+
+// apiUpdateUser applies the rules of the manage users page: only admins may
+// change admin accounts or who is an admin, nobody may disable or demote
+// themselves, and the last active admin stays
+func apiUpdateUser(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	user, ok := apiUserWithRoles(w, r)
+	if !ok {
+		return
+	}
+	var req APIUserUpdate
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+
+	if (user.IsAdmin || req.IsAdmin != nil) && !userClaims.IsAdmin {
+		writeAPIError(w, http.StatusForbidden, apiErrForbidden, "Only administrators can change administrator accounts")
+		return
+	}
+	if user.ID == userClaims.UserID && ((req.Disabled != nil && *req.Disabled) || (req.IsAdmin != nil && !*req.IsAdmin)) {
+		writeAPIError(w, http.StatusForbidden, apiErrForbidden, "You can't disable or demote your own account")
+		return
+	}
+
+	var changes []string
+	fail := func(err error) {
+		status, code := http.StatusBadRequest, apiErrBadRequest
+		if errors.Is(err, ErrLastAdmin) {
+			status, code = http.StatusConflict, apiErrConflict
+		}
+		message := Capitalize(err.Error())
+		if len(changes) > 0 {
+			message += " (already changed: " + strings.Join(changes, "; ") + ")"
+			authManager.Audit(r, AuditUserUpdate, user.Email, strings.Join(changes, "; ")+", API")
+		}
+		writeAPIError(w, status, code, message)
+	}
+
+	if req.Email != nil && strings.TrimSpace(*req.Email) != user.Email {
+		email := strings.TrimSpace(*req.Email)
+		if err := authManager.UpdateUserEmail(user.ID, email); err != nil {
+			fail(err)
+			return
+		}
+		changes = append(changes, "email changed from "+user.Email+" to "+email)
+		user.Email = email
+	}
+	if req.IsAdmin != nil && *req.IsAdmin != user.IsAdmin {
+		if err := authManager.SetUserAdmin(user.ID, *req.IsAdmin); err != nil {
+			fail(err)
+			return
+		}
+		user.IsAdmin = *req.IsAdmin
+		changes = append(changes, map[bool]string{true: "promoted", false: "demoted"}[user.IsAdmin])
+	}
+	if req.Disabled != nil && *req.Disabled != user.Disabled {
+		if err := authManager.SetUserDisabled(user.ID, *req.Disabled); err != nil {
+			fail(err)
+			return
+		}
+		user.Disabled = *req.Disabled
+		changes = append(changes, map[bool]string{true: "disabled", false: "enabled"}[user.Disabled])
+	}
+
+	before := Profile{Name: user.Name, PreferredName: user.PreferredName, StudentNumber: user.StudentNumber, Pronouns: user.Pronouns}
+	profile := before
+	for _, field := range []struct {
+		value *string
+		dest  *string
+	}{
+		{req.Name, &profile.Name},
+		{req.PreferredName, &profile.PreferredName},
+		{req.StudentNumber, &profile.StudentNumber},
+		{req.Pronouns, &profile.Pronouns},
+	} {
+		if field.value != nil {
+			*field.dest = strings.TrimSpace(*field.value)
+		}
+	}
+	section := user.Section
+	if req.Section != nil {
+		section = strings.TrimSpace(*req.Section)
+	}
+	if profile != before || section != user.Section {
+		err := authManager.UpdateUserProfile(user.ID, profile)
+		if err == nil && section != user.Section {
+			err = authManager.SetUserRosterInfo(user.ID, profile.Name, profile.StudentNumber, section)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		user.Name, user.PreferredName, user.StudentNumber, user.Pronouns, user.Section =
+			profile.Name, profile.PreferredName, profile.StudentNumber, profile.Pronouns, section
+		changes = append(changes, "profile updated")
+	}
+
+	if len(changes) > 0 {
+		authManager.Audit(r, AuditUserUpdate, user.Email, strings.Join(changes, "; ")+", API")
+	}
+	writeAPIJSON(w, http.StatusOK, user)
+}
+
+// POST /api/v1/users/{id}/{action}: disable, enable or resend-setup
+func handleAPIUserAction(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	if r.Method != "POST" {
+		writeAPIError(w, http.StatusMethodNotAllowed, apiErrMethod, "Use POST")
+		return
+	}
+	action := r.PathValue("action")
+	if action != "disable" && action != "enable" && action != "resend-setup" {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, fmt.Sprintf("Unknown action %q", action))
+		return
+	}
+	user, ok := apiUserWithRoles(w, r)
+	if !ok {
+		return
+	}
+	if user.IsAdmin && !userClaims.IsAdmin {
+		writeAPIError(w, http.StatusForbidden, apiErrForbidden, "Only administrators can change administrator accounts")
+		return
+	}
+
+	switch action {
+	case "disable", "enable":
+		disable := action == "disable"
+		if disable && user.ID == userClaims.UserID {
+			writeAPIError(w, http.StatusForbidden, apiErrForbidden, "You can't disable your own account")
+			return
+		}
+		if err := authManager.SetUserDisabled(user.ID, disable); err != nil {
+			status, code := http.StatusInternalServerError, apiErrInternal
+			if errors.Is(err, ErrLastAdmin) {
+				status, code = http.StatusConflict, apiErrConflict
+			}
+			writeAPIError(w, status, code, Capitalize(err.Error()))
+			return
+		}
+		user.Disabled = disable
+		authManager.Audit(r, AuditUserUpdate, user.Email, action+"d, API")
+
+	case "resend-setup":
+		if user.IsSetup {
+			writeAPIError(w, http.StatusConflict, apiErrConflict, user.Email+" has already completed setup")
+			return
+		}
+		if user.Disabled {
+			writeAPIError(w, http.StatusConflict, apiErrConflict, user.Email+" is disabled")
+			return
+		}
+		token, err := authManager.RegenerateSetupToken(user.ID)
+		if err == nil {
+			user.SetupToken = token
+			err = authManager.SendSetupEmail(user, baseURL(r))
+		}
+		if err != nil {
+			log.Printf("Error resending setup email to %s: %v", user.Email, err)
+			writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Failed to queue the setup email")
+			return
+		}
+		authManager.Audit(r, AuditSetupEmail, user.Email, "API")
+	}
+
+	writeAPIJSON(w, http.StatusOK, user)
+}
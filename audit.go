@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Audit log actions
+const (
+	AuditLogin          = "login"
+	AuditLoginFailed    = "login.failed"
+	AuditLogout         = "logout"
+	AuditSetup          = "account.setup"
+	AuditPasswordChange = "password.change"
+	AuditProfileUpdate  = "profile.update"
+	AuditUserCreate     = "user.create"
+	AuditSetupEmail     = "user.setup_email"
+	AuditUserUpdate     = "user.update"
+	AuditRoleUpdate     = "role.update"
+	AuditRosterImport   = "roster.import"
+	AuditUpload         = "upload"
+	AuditTwoFactor      = "two_factor"
+	AuditAPIToken       = "api_token"
+	AuditImpersonate    = "impersonate"
+	AuditEmailRetry     = "email.retry"
+	AuditBulkEmail      = "email.bulk"
+)
+
+var auditActions = []string{
+	AuditLogin, AuditLoginFailed, AuditLogout, AuditSetup, AuditPasswordChange, AuditProfileUpdate,
+	AuditUserCreate, AuditSetupEmail, AuditUserUpdate, AuditRoleUpdate, AuditRosterImport, AuditUpload,
+	AuditTwoFactor, AuditAPIToken, AuditImpersonate, AuditEmailRetry, AuditBulkEmail,
+}
+
+const (
+	auditPageLimit   = 200
+	auditExportLimit = 100000
+)
+
+type AuditEntry struct {
+	ID         int       `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ActorID    int       `json:"actor_id,omitempty"`
+	ActorEmail string    `json:"actor_email,omitempty"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target,omitempty"`
+	Details    string    `json:"details,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+}
+
+// AuditFilter selects audit log entries. Empty fields match everything.
+type AuditFilter struct {
+	User   string // substring of the actor's email or the target
+	Action string
+	Since  time.Time
+	Until  time.Time
+}
+
+type AuditLogPage struct {
+	Error   string
+	Entries []*AuditEntry
+	Actions []string
+	Filter  AuditFilter
+	Since   string // date inputs as entered
+	Until   string
+	Query   string // the filter as a query string, for the export link
+	Limited bool   // more entries matched than are shown
+	User    *AuthClaims
+	Nav     []NavItem
+}
+
+// Audit records an action taken by the signed-in user, or by the admin
+// viewing the site as them. Failures are logged rather than returned so that
+// auditing can never block the action itself.
+func (am *AuthManager) Audit(r *http.Request, action, target, details string) {
+	var actorID int
+	var actorEmail string
+	if claims := GetUserFromContext(r.Context()); claims != nil {
+		actorID, actorEmail = claims.UserID, claims.Email
+		if claims.ImpersonatedBy != 0 {
+			actorID, actorEmail = claims.ImpersonatedBy, claims.ImpersonatorEmail
+			details = strings.TrimSpace("as " + claims.Email + " " + details)
+		}
+	}
+	am.AuditAs(r, actorID, actorEmail, action, target, details)
+}
+
+// AuditAs records an action for a request with no session yet, such as a
+// login. r is nil for actions taken from the command line.
+func (am *AuthManager) AuditAs(r *http.Request, actorID int, actorEmail, action, target, details string) {
+	var id any
+	if actorID != 0 {
+		id = actorID
+	}
+	var ip string
+	if r != nil {
+		ip = clientIP(r)
+	}
+	_, err := am.db.Exec(`
+		INSERT INTO audit_log (created_at, actor_id, actor_email, action, target, details, ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, time.Now().UTC(), id, actorEmail, action, target, details, ip)
+	if err != nil {
+		log.Printf("Error writing audit log (%s %s by %s): %v", action, target, actorEmail, err)
+	}
+}
+
+func (am *AuthManager) GetAuditLog(filter AuditFilter, limit int) ([]*AuditEntry, error) {
+	var where []string
+	var args []any
+	if filter.User != "" {
+		where = append(where, "(LOWER(actor_email) LIKE LOWER(?) OR LOWER(target) LIKE LOWER(?))")
+		pattern := "%" + filter.User + "%"
+		args = append(args, pattern, pattern)
+	}
+	if filter.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.Until.UTC())
+	}
+
+	query := `SELECT id, created_at, COALESCE(actor_id, 0), COALESCE(actor_email, ''), action,
+		COALESCE(target, ''), COALESCE(details, ''), COALESCE(ip, '') FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := am.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		entry := &AuditEntry{}
+		err := rows.Scan(&entry.ID, &entry.CreatedAt, &entry.ActorID, &entry.ActorEmail, &entry.Action,
+			&entry.Target, &entry.Details, &entry.IP)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Admin page listing the audit log, filtered by user, action and date.
+// Add format=json to download the matching entries.
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	if !userClaims.Can(PermAuditView) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := AuditLogPage{User: userClaims, Nav: config.navItems, Actions: auditActions}
+
+	q := r.URL.Query()
+	page.Filter.User = strings.TrimSpace(q.Get("user"))
+	page.Filter.Action = q.Get("action")
+	page.Since = q.Get("since")
+	page.Until = q.Get("until")
+	var err error
+	if page.Since != "" {
+		if page.Filter.Since, err = time.ParseInLocation("2006-01-02", page.Since, time.Local); err != nil {
+			page.Error = "Invalid from date"
+		}
+	}
+	if page.Until != "" {
+		if page.Filter.Until, err = time.ParseInLocation("2006-01-02", page.Until, time.Local); err != nil {
+			page.Error = "Invalid to date"
+		} else {
+			// Include the whole of the last day
+			page.Filter.Until = page.Filter.Until.AddDate(0, 0, 1)
+		}
+	}
+
+	if q.Get("format") == "json" {
+		entries, err := authManager.GetAuditLog(page.Filter, auditExportLimit)
+		if err != nil {
+			panicf("Error getting audit log: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="audit-log-%s.json"`, time.Now().Format("2006-01-02")))
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(entries); err != nil {
+			log.Printf("Error writing audit log export: %v", err)
+		}
+		return
+	}
+
+	entries, err := authManager.GetAuditLog(page.Filter, auditPageLimit+1)
+	if err != nil {
+		panicf("Error getting audit log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(entries) > auditPageLimit {
+		entries = entries[:auditPageLimit]
+		page.Limited = true
+	}
+	page.Entries = entries
+
+	q.Set("format", "json")
+	page.Query = q.Encode()
+
+	if err := config.templates.ExecuteTemplate(w, "admin-audit-log.html", page); err != nil {
+		panicf("Error executing audit log template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func auditAdminDetail(isAdmin bool) string {
+	if isAdmin {
+		return "admin"
+	}
+	return ""
+}
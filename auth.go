@@ -1,22 +1,16 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
-	"database/sql"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
@@ -24,9 +18,16 @@ type User struct {
 	Email            string    `json:"email"`
 	Password         string    `json:"-"` // Never include in JSON
 	IsAdmin          bool      `json:"is_admin"`
-	SetupToken       string    `json:"-"` // Never include in JSON
+	SetupToken       string    `json:"-"` // only set when a token has just been issued; the database holds its hash
 	SetupTokenExpiry time.Time `json:"-"` // Never include in JSON
 	IsSetup          bool      `json:"is_setup"`
+	Disabled         bool      `json:"disabled"`
+	Name             string    `json:"name,omitempty"`
+	PreferredName    string    `json:"preferred_name,omitempty"`
+	StudentNumber    string    `json:"student_number,omitempty"`
+	Pronouns         string    `json:"pronouns,omitempty"`
+	Section          string    `json:"section,omitempty"`
+	Roles            []string  `json:"roles,omitempty"`
 	CreatedAt        time.Time `json:"created_at"`
 	UpdatedAt        time.Time `json:"updated_at"`
 }
@@ -35,110 +36,124 @@ type AuthClaims struct {
 	UserID  int    `json:"user_id"`
 	Email   string `json:"email"`
 	IsAdmin bool   `json:"is_admin"`
+	MFA     bool   `json:"mfa,omitempty"` // session passed a second factor
+
+	// Set when an admin is viewing the site as this user: the admin's ID.
+	// Such sessions can't make changes.
+	ImpersonatedBy    int    `json:"impersonated_by,omitempty"`
+	ImpersonatorEmail string `json:"-"` // loaded on every request
+
+	// Set for API token requests; nil for browser sessions
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Loaded from the user's roles on every request, never stored in the token
+	Permissions []string `json:"-"`
+
+	// Profile fields for templates, also loaded on every request
+	Name          string `json:"-"`
+	PreferredName string `json:"-"`
+	Pronouns      string `json:"-"`
 	jwt.RegisteredClaims
 }
 
+// HasScope reports whether the request may perform actions in scope.
+// Browser sessions have every scope.
+func (c *AuthClaims) HasScope(scope string) bool {
+	return c.Scopes == nil || containsString(c.Scopes, scope)
+}
+
 type AuthManager struct {
-	db        *sql.DB
+	db        *DB
+	users     UserStore
 	jwtSecret []byte
+	oidc      *oidcClient
+	mailer    Mailer
+
+	emailTemplates map[string]*emailTemplate
+	outboxWake     chan struct{} // see startOutbox
+
+	// Tried in order by ValidateCredentials
+	authenticators []Authenticator
+
+	passwordPolicy  PasswordPolicy
+	bannedPasswords map[string]bool // lowercased
+	passwordHash    PasswordHashConfig
+
+	// Set while no accounts exist; see startBootstrap
+	bootstrapMu        sync.Mutex
+	bootstrapTokenHash string
 }
 
-func NewAuthManager(dbPath string) (*AuthManager, error) {
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+func NewAuthManager(db *DB) (*AuthManager, error) {
+	am := &AuthManager{
+		db:         db,
+		users:      newSQLUserStore(db),
+		jwtSecret:  []byte("your-secret-key-change-this-in-production"), // TODO: Use env var
+		oidc:       &oidcClient{},
+		outboxWake: make(chan struct{}, 1),
 	}
 
-	am := &AuthManager{
-		db:        db,
-		jwtSecret: []byte("your-secret-key-change-this-in-production"), // TODO: Use env var
+	if config.LDAP.Enabled() {
+		am.authenticators = append(am.authenticators, &ldapAuthenticator{am: am, cfg: config.LDAP})
 	}
+	am.authenticators = append(am.authenticators, &localAuthenticator{am: am})
 
-	if err := am.createTables(); err != nil {
-		return nil, fmt.Errorf("failed to create tables: %w", err)
+	if err := am.loadPasswordPolicy(config.PasswordPolicy); err != nil {
+		return nil, err
+	}
+	var err error
+	if am.passwordHash, err = config.PasswordHash.withDefaults(); err != nil {
+		return nil, err
+	}
+	if am.mailer, err = newMailer(config.ServerConfig, config.EmailSenderName); err != nil {
+		return nil, err
+	}
+	if am.emailTemplates, err = loadEmailTemplates(emailTemplateDir); err != nil {
+		return nil, err
 	}
 
-	// Create default admin user if no users exist
-	if err := am.createDefaultAdmin(); err != nil {
-		log.Printf("Warning: Failed to create default admin: %v", err)
+	if err := am.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
-	return am, nil
-}
+	if err := am.createDefaultRoles(); err != nil {
+		return nil, fmt.Errorf("failed to create default roles: %w", err)
+	}
 
-func (am *AuthManager) createTables() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		email TEXT UNIQUE NOT NULL,
-		password TEXT,
-		is_admin BOOLEAN DEFAULT FALSE,
-		setup_token TEXT,
-		setup_token_expiry DATETIME,
-		is_setup BOOLEAN DEFAULT FALSE,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TRIGGER IF NOT EXISTS update_users_updated_at
-		AFTER UPDATE ON users
-		FOR EACH ROW
-		BEGIN
-			UPDATE users SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
-		END;
-	`
-
-	_, err := am.db.Exec(query)
-	return err
+	return am, nil
 }
 
-func (am *AuthManager) createDefaultAdmin() error {
-	var count int
-	err := am.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+// inTx runs fn in a database transaction, committed if fn returns nil.
+// users is the user store working inside it.
+func (am *AuthManager) inTx(fn func(tx *Tx, users UserStore) error) error {
+	tx, err := am.db.Begin()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to start transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	if count == 0 {
-		// Create default admin with the old password
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte("ahsahbeequen"), bcrypt.DefaultCost)
-		if err != nil {
-			return err
-		}
-
-		_, err = am.db.Exec(`
-			INSERT INTO users (email, password, is_admin, is_setup)
-			VALUES (?, ?, ?, ?)
-		`, "admin@comp3007.local", string(hashedPassword), true, true)
+	if err := fn(tx, am.users.WithTx(tx)); err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
 func (am *AuthManager) CreateUser(email string, isAdmin bool) (*User, error) {
+	return createUser(am.users, email, isAdmin)
+}
+
+// createUser adds a user who hasn't set up their account to users, which
+// may be working in a transaction
+func createUser(users UserStore, email string, isAdmin bool) (*User, error) {
 	// Generate setup token
 	token, err := generateSecureToken()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate setup token: %w", err)
 	}
 
-	expiry := time.Now().Add(7 * 24 * time.Hour) // 7 days
-
-	result, err := am.db.Exec(`
-		INSERT INTO users (email, is_admin, setup_token, setup_token_expiry)
-		VALUES (?, ?, ?, ?)
-	`, email, isAdmin, token, expiry)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %w", err)
-	}
-
-	id, err := result.LastInsertId()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user ID: %w", err)
-	}
+	expiry := time.Now().Add(setupTokenLifetime())
 
 	user := &User{
-		ID:               int(id),
 		Email:            email,
 		IsAdmin:          isAdmin,
 		SetupToken:       token,
@@ -147,219 +162,132 @@ func (am *AuthManager) CreateUser(email string, isAdmin bool) (*User, error) {
 		CreatedAt:        time.Now(),
 		UpdatedAt:        time.Now(),
 	}
+	if err := users.CreateUser(user, hashToken(token)); err != nil {
+		return nil, err
+	}
 
 	return user, nil
 }
 
-func (am *AuthManager) GetUserByEmail(email string) (*User, error) {
-	user := &User{}
-	var password sql.NullString
-	var setupToken sql.NullString
-	var setupTokenExpiry sql.NullTime
-
-	err := am.db.QueryRow(`
-		SELECT id, email, password, is_admin, setup_token, setup_token_expiry, is_setup, created_at, updated_at
-		FROM users WHERE email = ?
-	`, email).Scan(&user.ID, &user.Email, &password, &user.IsAdmin, &setupToken, &setupTokenExpiry, &user.IsSetup, &user.CreatedAt, &user.UpdatedAt)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
+// setupTokenLifetime is how long setup links last, from setup_token_hours
+func setupTokenLifetime() time.Duration {
+	if config.SetupTokenHours > 0 {
+		return time.Duration(config.SetupTokenHours) * time.Hour
 	}
+	return 7 * 24 * time.Hour
+}
 
-	// Handle nullable fields
-	if password.Valid {
-		user.Password = password.String
-	}
-	if setupToken.Valid {
-		user.SetupToken = setupToken.String
-	}
-	if setupTokenExpiry.Valid {
-		user.SetupTokenExpiry = setupTokenExpiry.Time
-	}
+// describeDuration writes a whole number of days or hours for emails
+func describeDuration(d time.Duration) string {
+	hours := int(d.Hours())
+	switch {
+	case hours%24 == 0 && hours > 24:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours == 24:
+		return "1 day"
+	case hours == 1:
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d hours", hours)
+}
 
-	return user, nil
+func (am *AuthManager) GetUserByEmail(email string) (*User, error) {
+	return am.users.GetUserByEmail(email)
 }
 
 func (am *AuthManager) GetUserByID(id int) (*User, error) {
-	user := &User{}
-	var password sql.NullString
-	var setupToken sql.NullString
-	var setupTokenExpiry sql.NullTime
-
-	err := am.db.QueryRow(`
-		SELECT id, email, password, is_admin, setup_token, setup_token_expiry, is_setup, created_at, updated_at
-		FROM users WHERE id = ?
-	`, id).Scan(&user.ID, &user.Email, &password, &user.IsAdmin, &setupToken, &setupTokenExpiry, &user.IsSetup, &user.CreatedAt, &user.UpdatedAt)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
-	}
-
-	// Handle nullable fields
-	if password.Valid {
-		user.Password = password.String
-	}
-	if setupToken.Valid {
-		user.SetupToken = setupToken.String
-	}
-	if setupTokenExpiry.Valid {
-		user.SetupTokenExpiry = setupTokenExpiry.Time
-	}
-
-	return user, nil
+	return am.users.GetUserByID(id)
 }
 
+// GetUserBySetupToken finds the user a setup link was sent to. Only the
+// token's hash is stored.
 func (am *AuthManager) GetUserBySetupToken(token string) (*User, error) {
-	user := &User{}
-	var password sql.NullString
-	var setupToken sql.NullString
-	var setupTokenExpiry sql.NullTime
-
-	err := am.db.QueryRow(`
-		SELECT id, email, password, is_admin, setup_token, setup_token_expiry, is_setup, created_at, updated_at
-		FROM users WHERE setup_token = ? AND setup_token_expiry > CURRENT_TIMESTAMP
-	`, token).Scan(&user.ID, &user.Email, &password, &user.IsAdmin, &setupToken, &setupTokenExpiry, &user.IsSetup, &user.CreatedAt, &user.UpdatedAt)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
-	}
-
-	// Handle nullable fields
-	if password.Valid {
-		user.Password = password.String
-	}
-	if setupToken.Valid {
-		user.SetupToken = setupToken.String
-	}
-	if setupTokenExpiry.Valid {
-		user.SetupTokenExpiry = setupTokenExpiry.Time
-	}
-
-	return user, nil
+	return am.users.GetUserBySetupTokenHash(hashToken(token))
 }
 
 func (am *AuthManager) GetAllUsers() ([]*User, error) {
-	rows, err := am.db.Query(`
-		SELECT id, email, is_admin, is_setup, created_at, updated_at
-		FROM users ORDER BY created_at DESC
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var users []*User
-	for rows.Next() {
-		user := &User{}
-		err := rows.Scan(&user.ID, &user.Email, &user.IsAdmin, &user.IsSetup, &user.CreatedAt, &user.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-		users = append(users, user)
-	}
-	return users, nil
+	return am.users.GetAllUsers()
 }
 
 func (am *AuthManager) SetupUserPassword(token, password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := am.HashPassword(password)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	result, err := am.db.Exec(`
-		UPDATE users
-		SET password = ?, is_setup = TRUE, setup_token = NULL, setup_token_expiry = NULL, updated_at = CURRENT_TIMESTAMP
-		WHERE setup_token = ? AND setup_token_expiry > CURRENT_TIMESTAMP
-	`, string(hashedPassword), token)
-	if err != nil {
-		return fmt.Errorf("failed to update user password: %w", err)
-	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to check affected rows: %w", err)
-	}
-
-	if rowsAffected == 0 {
-		return fmt.Errorf("invalid or expired setup token")
-	}
-
-	return nil
+	return am.users.CompleteSetup(hashToken(token), hashedPassword)
 }
 
 func (am *AuthManager) UpdateUserPassword(userID int, password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := am.HashPassword(password)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	_, err = am.db.Exec(`
-		UPDATE users
-		SET password = ?, updated_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, string(hashedPassword), userID)
-	if err != nil {
-		return fmt.Errorf("failed to update user password: %w", err)
-	}
+	return am.users.SetPassword(userID, hashedPassword)
+}
 
-	return nil
+// MarkUserSetup completes account setup for a user whose identity was
+// verified elsewhere (e.g. single sign-on), without setting a password.
+func (am *AuthManager) MarkUserSetup(userID int) error {
+	return am.users.MarkSetup(userID)
+}
+
+// SetUserAdmin promotes or demotes a user. The last active admin can't be
+// demoted.
+func (am *AuthManager) SetUserAdmin(userID int, isAdmin bool) error {
+	return am.inTx(func(tx *Tx, users UserStore) error {
+		if !isAdmin {
+			if err := checkNotLastAdmin(users, userID); err != nil {
+				return err
+			}
+		}
+		return users.SetAdmin(userID, isAdmin)
+	})
 }
 
+// RegenerateSetupToken issues a new setup token for a user. Any earlier
+// token stops working at once, since only the newest hash is kept.
 func (am *AuthManager) RegenerateSetupToken(userID int) (string, error) {
 	token, err := generateSecureToken()
 	if err != nil {
 		return "", fmt.Errorf("failed to generate setup token: %w", err)
 	}
 
-	expiry := time.Now().Add(7 * 24 * time.Hour) // 7 days
+	expiry := time.Now().Add(setupTokenLifetime())
 
-	_, err = am.db.Exec(`
-		UPDATE users
-		SET setup_token = ?, setup_token_expiry = ?, updated_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, token, expiry, userID)
-	if err != nil {
-		return "", fmt.Errorf("failed to update setup token: %w", err)
+	if err := am.users.SetSetupToken(userID, hashToken(token), expiry); err != nil {
+		return "", err
 	}
 
 	return token, nil
 }
 
+// ValidateCredentials checks email and password against each configured
+// authenticator in turn, falling back to local passwords last. Disabled
+// accounts are rejected whichever authenticator accepts them.
 func (am *AuthManager) ValidateCredentials(email, password string) (*User, error) {
-	user, err := am.GetUserByEmail(email)
-	if err != nil {
-		return nil, err
-	}
-	if user == nil {
-		return nil, fmt.Errorf("user not found")
-	}
-
-	if !user.IsSetup {
-		return nil, fmt.Errorf("user account not set up")
-	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-	if err != nil {
-		return nil, fmt.Errorf("invalid credentials")
+	for _, authenticator := range am.authenticators {
+		user, err := authenticator.Authenticate(email, password)
+		if err == nil {
+			if user.Disabled {
+				return nil, ErrAccountDisabled
+			}
+			return user, nil
+		}
+		if err != ErrInvalidCredentials {
+			log.Printf("%s authentication for %s failed: %v", authenticator.Name(), email, err)
+		}
 	}
-
-	return user, nil
+	return nil, ErrInvalidCredentials
 }
 
-func (am *AuthManager) GenerateJWT(user *User) (string, error) {
+func (am *AuthManager) GenerateJWT(user *User, mfa bool) (string, error) {
 	claims := AuthClaims{
 		UserID:  user.ID,
 		Email:   user.Email,
 		IsAdmin: user.IsAdmin,
+		MFA:     mfa,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -390,21 +318,106 @@ func (am *AuthManager) ValidateJWT(tokenString string) (*AuthClaims, error) {
 	return nil, fmt.Errorf("invalid token")
 }
 
+// authFailure is why authenticate turned a request away
+type authFailure struct {
+	status      int // http.StatusUnauthorized when the request needs to sign in
+	message     string
+	clearCookie bool // the session cookie is no longer any good
+}
+
+// authenticate identifies the user behind a request from its API token or
+// session cookie, and loads what RequireAuth puts in the request context
+func (am *AuthManager) authenticate(r *http.Request) (*AuthClaims, *authFailure) {
+	internalError := &authFailure{status: http.StatusInternalServerError, message: "Internal Server Error"}
+
+	// Scripts and CLI tools authenticate with a personal API token
+	if token := bearerToken(r); token != "" {
+		claims, err := am.ValidateAPIToken(token)
+		if err != nil {
+			return nil, &authFailure{status: http.StatusUnauthorized, message: "Invalid API token"}
+		}
+		if claims.Permissions, err = am.GetUserPermissions(claims.UserID); err != nil {
+			return nil, internalError
+		}
+		return claims, nil
+	}
+
+	signIn := &authFailure{status: http.StatusUnauthorized, message: "Sign in required"}
+	cookie, err := r.Cookie("auth_token")
+	if err != nil {
+		return nil, signIn
+	}
+
+	claims, err := am.ValidateJWT(cookie.Value)
+	if err != nil {
+		return nil, signIn
+	}
+
+	// The account may have been disabled, deleted or demoted since the
+	// token was issued
+	user, err := am.GetUserByID(claims.UserID)
+	if err != nil {
+		return nil, internalError
+	}
+	if user == nil || user.Disabled {
+		signIn.clearCookie = true
+		return nil, signIn
+	}
+	claims.Email = user.Email
+	claims.IsAdmin = user.IsAdmin
+	claims.Name = user.Name
+	claims.PreferredName = user.PreferredName
+	claims.Pronouns = user.Pronouns
+
+	// Roles can change during a session, so permissions are looked up
+	// on every request
+	if claims.Permissions, err = am.GetUserPermissions(claims.UserID); err != nil {
+		return nil, internalError
+	}
+
+	if claims.ImpersonatedBy != 0 {
+		// The admin must still be one for the impersonation to last
+		admin, err := am.GetUserByID(claims.ImpersonatedBy)
+		if err != nil {
+			return nil, internalError
+		}
+		if admin == nil || admin.Disabled || !admin.IsAdmin {
+			signIn.clearCookie = true
+			return nil, signIn
+		}
+		claims.ImpersonatorEmail = admin.Email
+
+		if isStateChanging(r.Method) {
+			return nil, &authFailure{
+				status:  http.StatusForbidden,
+				message: "Forbidden: changes can't be made while viewing the site as another user",
+			}
+		}
+	}
+	return claims, nil
+}
+
 func (am *AuthManager) RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if config.AuthDisabled {
 			next(w, r)
 			return
 		}
-		cookie, err := r.Cookie("auth_token")
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
 
-		claims, err := am.ValidateJWT(cookie.Value)
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		claims, failure := am.authenticate(r)
+		if failure != nil {
+			if failure.clearCookie {
+				http.SetCookie(w, &http.Cookie{Name: "auth_token", Value: "", Path: "/", HttpOnly: true, Secure: isHTTPS(r), MaxAge: -1})
+			}
+			switch {
+			case failure.status == http.StatusUnauthorized && bearerToken(r) != "":
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, failure.message, failure.status)
+			case failure.status == http.StatusUnauthorized:
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+			default:
+				http.Error(w, failure.message, failure.status)
+			}
 			return
 		}
 
@@ -425,142 +438,19 @@ func (am *AuthManager) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
 			http.Error(w, "Access denied: admin required", http.StatusForbidden)
 			return
 		}
+		if am.needsSecondFactor(claims) {
+			http.Redirect(w, r, "/profile?two_factor=required", http.StatusSeeOther)
+			return
+		}
 		next(w, r)
 	})
 }
 
-func (am *AuthManager) SendSetupEmail(user *User, baseURL string) error {
-	setupURL := fmt.Sprintf("%s/setup?token=%s", baseURL, user.SetupToken)
-
-	// For development, log the setup URL
-	log.Printf("Setup email for %s: %s", user.Email, setupURL)
-
-	htmlBody := fmt.Sprintf(`
-<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="utf-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>COMP 3007 Account Setup</title>
-    <style>
-        body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; margin: 0; padding: 0; background-color: #f4f4f4; }
-        .container { max-width: 600px; margin: 0 auto; background: white; padding: 20px; border-radius: 8px; margin-top: 20px; }
-        .header { background: #2563eb; color: white; padding: 20px; border-radius: 8px 8px 0 0; text-align: center; margin: -20px -20px 20px -20px; }
-        .button { display: inline-block; background: #2563eb; color: white; padding: 12px 24px; text-decoration: none; border-radius: 5px; margin: 10px 0; }
-        .footer { margin-top: 20px; padding-top: 20px; border-top: 1px solid #eee; font-size: 12px; color: #666; }
-        .url-box { background: #f8f9fa; padding: 10px; border-radius: 4px; font-family: monospace; font-size: 12px; word-break: break-all; }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="header">
-            <h2 style="margin: 0;">Welcome to COMP 3007</h2>
-            <p style="margin: 5px 0 0 0;">Programming Paradigms</p>
-        </div>
-
-        <p>Hello!</p>
-
-        <p>Your account has been created for the COMP 3007 course website. To get started, you need to set up your password.</p>
-
-        <p style="text-align: center;">
-            <a href="%s" class="button">Set Up Your Account</a>
-        </p>
-
-        <p><strong>Important:</strong> This setup link will expire in 7 days. If you don't set up your account within this time, please contact your instructor.</p>
-
-        <p>If the button above doesn't work, you can copy and paste this URL into your browser:</p>
-        <div class="url-box">%s</div>
-
-        <div class="footer">
-            <p>This email was sent automatically by the COMP 3007 course management system. If you believe you received this email in error, please contact your instructor.</p>
-            <p>COMP 3007 - Programming Paradigms</p>
-        </div>
-    </div>
-</body>
-</html>`, setupURL, setupURL)
-
-	return am.sendEmailWithResend(user.Email, "COMP 3007 Account Setup", htmlBody)
-}
-
-// ResendEmailRequest represents the JSON payload for Resend API
-type ResendEmailRequest struct {
-	From    string   `json:"from"`
-	To      []string `json:"to"`
-	Subject string   `json:"subject"`
-	Html    string   `json:"html"`
-}
-
-// ResendEmailResponse represents the response from Resend API
-type ResendEmailResponse struct {
-	Id string `json:"id"`
-}
-
-func (am *AuthManager) sendEmailWithResend(to, subject, htmlBody string) error {
-	apiKey := os.Getenv("RESEND_API_KEY")
-	fromEmail := os.Getenv("FROM_EMAIL")
-
-	// For development/testing, just log the email if API key is not configured
-	if apiKey == "" {
-		log.Printf("Resend API key not configured, logging email instead:")
-		log.Printf("TO: %s", to)
-		log.Printf("SUBJECT: %s", subject)
-		log.Printf("BODY: %s", htmlBody)
-		return nil
-	}
-
-	if fromEmail == "" {
-		fromEmail = "onboarding@resend.dev" // Resend's test domain
-	}
-
-	// Prepare the email payload
-	emailRequest := ResendEmailRequest{
-		From:    fromEmail,
-		To:      []string{to},
-		Subject: subject,
-		Html:    htmlBody,
-	}
-
-	// Convert to JSON
-	jsonData, err := json.Marshal(emailRequest)
-	if err != nil {
-		return fmt.Errorf("failed to marshal email request: %w", err)
-	}
-
-	// Create HTTP request
-	req, err := http.NewRequest("POST", "https://api.resend.com/emails", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %w", err)
-	}
-
-	// Set headers
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send HTTP request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		// Read the response body for more detailed error information
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		bodyString := string(bodyBytes)
-		log.Printf("Resend API error response: %s", bodyString)
-		return fmt.Errorf("Resend API returned status %d: %s - %s", resp.StatusCode, resp.Status, bodyString)
-	}
-
-	// Parse response
-	var emailResponse ResendEmailResponse
-	if err := json.NewDecoder(resp.Body).Decode(&emailResponse); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	log.Printf("Email sent successfully to %s via Resend API (ID: %s)", to, emailResponse.Id)
-	return nil
+// needsSecondFactor reports whether an admin session must pass two-factor
+// authentication before using admin routes. API tokens are exempt; creating
+// an admin token already required it.
+func (am *AuthManager) needsSecondFactor(claims *AuthClaims) bool {
+	return config.RequireAdmin2FA && claims.IsAdmin && !claims.MFA && claims.Scopes == nil
 }
 
 func generateSecureToken() (string, error) {
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupTest points the config and auth manager at a SQLite database, new
+// unless serverConfig names one, restoring them when the test ends
+func setupTest(t *testing.T, serverConfig ServerConfig) {
+	savedConfig, savedAuthManager := config, authManager
+	t.Cleanup(func() { config, authManager = savedConfig, savedAuthManager })
+
+	if serverConfig.DBPath == "" {
+		serverConfig.DBPath = filepath.Join(t.TempDir(), "users.db")
+	}
+	config = &Config{ServerConfig: serverConfig}
+
+	db, err := openDatabase(config.ServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if authManager, err = NewAuthManager(db); err != nil {
+		t.Fatal(err)
+	}
+	if config.templates, err = parseTemplates("templates/*.html"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestUser creates a user who has finished setting up their account
+func newTestUser(t *testing.T, email string, isAdmin bool) *User {
+	user, err := authManager.CreateUser(email, isAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authManager.SetupUserPassword(user.SetupToken, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = authManager.GetUserByID(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+const testPassword = "Zq9-longpassword-x"
+
+func TestSetupTokenStoredHashed(t *testing.T) {
+	setupTest(t, ServerConfig{})
+	user, err := authManager.CreateUser("new@example.edu", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := authManager.db.Query(`SELECT * FROM users WHERE id = ?`, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columns, _ := rows.Columns()
+	values := make([]any, len(columns))
+	for i := range values {
+		values[i] = new(any)
+	}
+	if !rows.Next() {
+		t.Fatal("the new user wasn't stored")
+	}
+	if err := rows.Scan(values...); err != nil {
+		t.Fatal(err)
+	}
+	var hashStored bool
+	for i, column := range columns {
+		value := *values[i].(*any)
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		if s, ok := value.(string); ok && strings.Contains(s, user.SetupToken) {
+			t.Errorf("column %s holds the plaintext setup token", column)
+		}
+		if column == "setup_token_hash" && value == hashToken(user.SetupToken) {
+			hashStored = true
+		}
+	}
+	if !hashStored {
+		t.Error("setup_token_hash doesn't hold the token's hash")
+	}
+
+	if found, _ := authManager.GetUserBySetupToken(hashToken(user.SetupToken)); found != nil {
+		t.Error("the stored hash works as a setup token")
+	}
+}
+
+func TestSetupUserPasswordToken(t *testing.T) {
+	setupTest(t, ServerConfig{})
+	user, err := authManager.CreateUser("new@example.edu", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer token replaces the first
+	token, err := authManager.RegenerateSetupToken(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authManager.SetupUserPassword(user.SetupToken, testPassword); !errors.Is(err, ErrInvalidSetupToken) {
+		t.Errorf("a replaced token: got %v, want ErrInvalidSetupToken", err)
+	}
+
+	if err := authManager.SetupUserPassword(token, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if err := authManager.SetupUserPassword(token, "another-long-password"); !errors.Is(err, ErrInvalidSetupToken) {
+		t.Errorf("a used token: got %v, want ErrInvalidSetupToken", err)
+	}
+
+	expired, err := authManager.RegenerateSetupToken(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authManager.users.SetSetupToken(user.ID, hashToken(expired), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := authManager.SetupUserPassword(expired, testPassword); !errors.Is(err, ErrInvalidSetupToken) {
+		t.Errorf("an expired token: got %v, want ErrInvalidSetupToken", err)
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"log"
+)
+
+// Authenticator checks a user's primary credentials. ValidateCredentials
+// tries each configured authenticator in turn, so an external directory can
+// sit in front of the local password store.
+type Authenticator interface {
+	Name() string
+	Authenticate(email, password string) (*User, error)
+}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrAccountDisabled    = errors.New("account disabled")
+)
+
+// localAuthenticator checks the password hash in the users table. Hashes
+// made with an older algorithm or settings are replaced on a successful
+// check, while the plain password is at hand.
+type localAuthenticator struct {
+	am *AuthManager
+}
+
+func (a *localAuthenticator) Name() string {
+	return "local"
+}
+
+func (a *localAuthenticator) Authenticate(email, password string) (*User, error) {
+	user, err := a.am.GetUserByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	// Unknown and not-yet-setup users get the same error as a wrong password
+	if user == nil || !user.IsSetup {
+		return nil, ErrInvalidCredentials
+	}
+
+	ok, err := checkPasswordHash(user.Password, password)
+	if err != nil {
+		log.Printf("Error checking password hash for %s: %v", email, err)
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	if a.am.needsRehash(user.Password) {
+		if err := a.am.UpdateUserPassword(user.ID, password); err != nil {
+			log.Printf("Error upgrading password hash for %s: %v", email, err)
+		}
+	}
+
+	return user, nil
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Passwords that shipped as defaults in earlier versions. Accounts still
+// using one are reported at startup.
+var defaultPasswords = []string{"ahsahbeequen"}
+
+// The account older versions created with the first default password
+const legacyAdminEmail = "admin@comp3007.local"
+
+var ErrBootstrapDone = errors.New("the first administrator has already been created")
+
+// startBootstrap lets the first administrator be created from the browser.
+// While there are no accounts, a one-time token is logged at startup; it
+// leads to /bootstrap and lasts until it is used or the server restarts.
+func (am *AuthManager) startBootstrap() error {
+	count, err := am.users.CountUsers()
+	if err != nil || count > 0 {
+		return err
+	}
+
+	token, err := generateSecureToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate bootstrap token: %w", err)
+	}
+	am.bootstrapMu.Lock()
+	am.bootstrapTokenHash = hashToken(token)
+	am.bootstrapMu.Unlock()
+
+	log.Printf("No accounts exist yet. Create the first administrator at %s/bootstrap?token=%s", startupBaseURL(), token)
+	log.Printf("Or run: server create-admin --email <address> <server config file>")
+	return nil
+}
+
+// CreateFirstAdmin uses up the bootstrap token to create a set-up admin
+// account. It fails once any account exists.
+func (am *AuthManager) CreateFirstAdmin(token, email, password string) (*User, error) {
+	am.bootstrapMu.Lock()
+	defer am.bootstrapMu.Unlock()
+
+	if !am.validBootstrapToken(token) {
+		return nil, ErrBootstrapDone
+	}
+	count, err := am.users.CountUsers()
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		am.bootstrapTokenHash = ""
+		return nil, ErrBootstrapDone
+	}
+
+	if !isValidEmail(email) {
+		return nil, fmt.Errorf("invalid email address: %s", email)
+	}
+	if err := am.CheckPassword(password, email); err != nil {
+		return nil, err
+	}
+	hashedPassword, err := am.HashPassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	user := &User{Email: email, Password: hashedPassword, IsAdmin: true, IsSetup: true}
+	if err := am.users.CreateUser(user, ""); err != nil {
+		return nil, err
+	}
+	am.bootstrapTokenHash = ""
+	return user, nil
+}
+
+// validBootstrapToken must be called with bootstrapMu held
+func (am *AuthManager) validBootstrapToken(token string) bool {
+	return am.bootstrapTokenHash != "" &&
+		subtle.ConstantTimeCompare([]byte(am.bootstrapTokenHash), []byte(hashToken(token))) == 1
+}
+
+// warnDefaultPasswords logs a warning for each admin account, and the
+// account older versions created, that still has a default password. Only
+// those are checked, since hashing is deliberately slow.
+func (am *AuthManager) warnDefaultPasswords() {
+	users, err := am.users.GetAllUsers()
+	if err != nil {
+		log.Printf("Warning: failed to check for default passwords: %v", err)
+		return
+	}
+	for _, user := range users {
+		if user.Password == "" || (!user.IsAdmin && user.Email != legacyAdminEmail) {
+			continue
+		}
+		for _, password := range defaultPasswords {
+			if ok, _ := checkPasswordHash(user.Password, password); ok {
+				log.Printf("WARNING: %s still has a default password that is publicly known. "+
+					"Change it now, or disable the account if it isn't needed.", user.Email)
+			}
+		}
+	}
+}
+
+// CreateAdmin runs the "create-admin" command: it creates an admin account
+// and prints a link for setting its password. It works whether or not other
+// accounts exist, so it can also recover from losing every admin.
+func CreateAdmin(serverConfigFile, email string, out io.Writer) error {
+	am, err := openForCommand(serverConfigFile)
+	if err != nil {
+		return err
+	}
+	defer am.db.Close()
+
+	email = strings.TrimSpace(email)
+	if !isValidEmail(email) {
+		return fmt.Errorf("invalid email address: %q", email)
+	}
+	existing, err := am.GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("%s already has an account", email)
+	}
+
+	user, err := am.CreateUser(email, true)
+	if err != nil {
+		return err
+	}
+	am.AuditAs(nil, 0, "", AuditUserCreate, user.Email, "administrator, from the command line")
+
+	fmt.Fprintf(out, "Created administrator %s. Set its password within %s at:\n%s/setup?token=%s\n",
+		user.Email, describeDuration(setupTokenLifetime()), startupBaseURL(), user.SetupToken)
+	return nil
+}
+
+// Create the first administrator with the token logged at startup
+func handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	authManager.bootstrapMu.Lock()
+	valid := authManager.validBootstrapToken(token)
+	authManager.bootstrapMu.Unlock()
+	if !valid {
+		http.Error(w, "Invalid or used bootstrap token", http.StatusBadRequest)
+		return
+	}
+
+	page := BootstrapPage{Token: token, Email: r.FormValue("email"), Policy: authManager.PasswordPolicy()}
+
+	if r.Method == "GET" {
+		if err := config.templates.ExecuteTemplate(w, "bootstrap.html", page); err != nil {
+			panicf("Error executing bootstrap template: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	password := r.FormValue("password")
+	if password != r.FormValue("confirm_password") {
+		page.Error = "Passwords do not match"
+	} else {
+		user, err := authManager.CreateFirstAdmin(token, strings.TrimSpace(page.Email), password)
+		if err == nil {
+			authManager.AuditAs(r, user.ID, user.Email, AuditUserCreate, user.Email, "first administrator")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if err == ErrBootstrapDone {
+			http.Error(w, Capitalize(err.Error()), http.StatusBadRequest)
+			return
+		}
+		page.Error = Capitalize(err.Error())
+	}
+
+	if err := config.templates.ExecuteTemplate(w, "bootstrap.html", page); err != nil {
+		panicf("Error executing bootstrap template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
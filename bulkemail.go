@@ -0,0 +1,278 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Audiences for bulk email. Disabled users are never included. Sections and
+// roles are chosen as "section:<name>" and "role:<name>".
+const (
+	audienceAll           = "all"
+	audienceAdmins        = "admins"
+	audiencePending       = "pending"
+	audienceSectionPrefix = "section:"
+	audienceRolePrefix    = "role:"
+)
+
+const (
+	bulkEmailHistoryLimit = 50
+	bulkEmailPreviewLimit = 20 // recipients listed in a preview
+)
+
+// AudienceOption is one choice of recipients on the compose page
+type AudienceOption struct {
+	Value string
+	Label string
+	Count int
+}
+
+// BulkEmail is a message sent from the compose page
+type BulkEmail struct {
+	ID          int
+	SenderEmail string
+	Audience    string // the audience's label when it was sent
+	Subject     string
+	Body        string // Markdown
+	Recipients  int
+	Failed      int // recipients whose email couldn't be queued
+	CreatedAt   time.Time
+}
+
+func (m *BulkEmail) BodyHTML() template.HTML {
+	return template.HTML(renderStaffMarkdown([]byte(m.Body)))
+}
+
+type ComposeEmailPage struct {
+	Error     string
+	Success   string
+	Audiences []AudienceOption
+	Audience  string
+	Subject   string
+	Body      string
+
+	// Set by Preview
+	Preview        string // the email's HTML, shown in a frame
+	PreviewTo      []string
+	PreviewCount   int
+	PreviewSubject string
+
+	History []*BulkEmail
+	User    *AuthClaims
+	Nav     []NavItem
+}
+
+// audienceMembers returns the users an audience reaches. users need their
+// roles filled in.
+func audienceMembers(users []*User, audience string) []*User {
+	var members []*User
+	for _, user := range users {
+		if user.Disabled {
+			continue
+		}
+		var ok bool
+		switch {
+		case audience == audienceAll:
+			ok = true
+		case audience == audienceAdmins:
+			ok = user.IsAdmin
+		case audience == audiencePending:
+			ok = !user.IsSetup
+		case strings.HasPrefix(audience, audienceSectionPrefix):
+			ok = user.Section == strings.TrimPrefix(audience, audienceSectionPrefix)
+		case strings.HasPrefix(audience, audienceRolePrefix):
+			ok = containsString(user.Roles, strings.TrimPrefix(audience, audienceRolePrefix))
+		}
+		if ok {
+			members = append(members, user)
+		}
+	}
+	return members
+}
+
+// emailAudiences lists the fixed audiences, then every section and role that
+// some user has
+func emailAudiences(users []*User) []AudienceOption {
+	options := []AudienceOption{
+		{Value: audienceAll, Label: "Everyone"},
+		{Value: audienceAdmins, Label: "Administrators"},
+		{Value: audiencePending, Label: "Users who haven't set up their account"},
+	}
+
+	sections := map[string]bool{}
+	roles := map[string]bool{}
+	for _, user := range users {
+		if user.Section != "" {
+			sections[user.Section] = true
+		}
+		for _, role := range user.Roles {
+			roles[role] = true
+		}
+	}
+	for _, section := range sortedKeys(sections) {
+		options = append(options, AudienceOption{Value: audienceSectionPrefix + section, Label: "Section " + section})
+	}
+	for _, role := range sortedKeys(roles) {
+		options = append(options, AudienceOption{Value: audienceRolePrefix + role, Label: "Role: " + role})
+	}
+
+	for i := range options {
+		options[i].Count = len(audienceMembers(users, options[i].Value))
+	}
+	return options
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RecordBulkEmail adds a sent message to the history
+func (am *AuthManager) RecordBulkEmail(senderID int, m *BulkEmail) error {
+	m.CreatedAt = time.Now()
+	err := am.db.QueryRow(`
+		INSERT INTO bulk_emails (sender_id, sender_email, audience, subject, body, recipients, failed, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id
+	`, senderID, m.SenderEmail, m.Audience, m.Subject, m.Body, m.Recipients, m.Failed, m.CreatedAt).Scan(&m.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record sent message: %w", err)
+	}
+	return nil
+}
+
+// GetBulkEmails returns sent messages, newest first
+func (am *AuthManager) GetBulkEmails(limit int) ([]*BulkEmail, error) {
+	rows, err := am.db.Query(`
+		SELECT id, sender_email, audience, subject, body, recipients, failed, created_at
+		FROM bulk_emails ORDER BY id DESC LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*BulkEmail
+	for rows.Next() {
+		m := &BulkEmail{}
+		err := rows.Scan(&m.ID, &m.SenderEmail, &m.Audience, &m.Subject, &m.Body, &m.Recipients, &m.Failed, &m.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// Compose a Markdown message to a group of users, preview it, and send it
+// through the outbox
+func handleComposeEmail(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	if !userClaims.Can(PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	users, err := authManager.usersWithRoles()
+	if err != nil {
+		panicf("Error getting users: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	page := ComposeEmailPage{
+		Audiences: emailAudiences(users),
+		Audience:  r.FormValue("audience"),
+		Subject:   strings.TrimSpace(r.FormValue("subject")),
+		Body:      r.FormValue("body"),
+		User:      userClaims,
+		Nav:       config.navItems,
+	}
+
+	if r.Method == "POST" {
+		action := r.FormValue("action")
+		if action != "preview" && action != "send" {
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+
+		var audience *AudienceOption
+		for i := range page.Audiences {
+			if page.Audiences[i].Value == page.Audience {
+				audience = &page.Audiences[i]
+			}
+		}
+		recipients := audienceMembers(users, page.Audience)
+		switch {
+		case audience == nil:
+			page.Error = "Choose who to send the message to"
+		case len(recipients) == 0:
+			page.Error = audience.Label + " has no active users"
+		case page.Subject == "":
+			page.Error = "Subject is required"
+		case strings.TrimSpace(page.Body) == "":
+			page.Error = "Message is required"
+
+		case action == "preview":
+			msg, err := authManager.renderEmail(emailAnnouncement, announcementData(recipients[0].Email, page.Subject, page.Body))
+			if err != nil {
+				page.Error = Capitalize(err.Error())
+				break
+			}
+			page.Preview = msg.HTML
+			page.PreviewSubject = msg.Subject
+			page.PreviewCount = len(recipients)
+			for _, user := range recipients[:min(len(recipients), bulkEmailPreviewLimit)] {
+				page.PreviewTo = append(page.PreviewTo, user.Email)
+			}
+
+		case action == "send":
+			sent := &BulkEmail{
+				SenderEmail: userClaims.Email,
+				Audience:    audience.Label,
+				Subject:     page.Subject,
+				Body:        page.Body,
+				Recipients:  len(recipients),
+			}
+			for _, user := range recipients {
+				if err := authManager.SendAnnouncementEmail(user.Email, page.Subject, page.Body); err != nil {
+					log.Printf("Error queueing message to %s: %v", user.Email, err)
+					sent.Failed++
+				}
+			}
+			if err := authManager.RecordBulkEmail(userClaims.UserID, sent); err != nil {
+				log.Printf("Error recording sent message: %v", err)
+			}
+			details := fmt.Sprintf("%q to %s, %d recipients", page.Subject, audience.Label, len(recipients))
+			authManager.Audit(r, AuditBulkEmail, "", details)
+
+			page.Success = fmt.Sprintf("Message queued for %d users (%s)", len(recipients)-sent.Failed, audience.Label)
+			if sent.Failed > 0 {
+				page.Error = fmt.Sprintf("%d emails couldn't be queued; see the server log", sent.Failed)
+			}
+			page.Audience, page.Subject, page.Body = "", "", ""
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if page.History, err = authManager.GetBulkEmails(bulkEmailHistoryLimit); err != nil {
+		panicf("Error getting sent messages: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := config.templates.ExecuteTemplate(w, "admin-compose-email.html", page); err != nil {
+		panicf("Error executing compose email template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -1,11 +1,56 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"server"
 )
 
+const usage = `Usage:
+  server <config file>                          run the server
+  server migrate status|up <config file>        show or apply database migrations
+  server create-admin --email <address> <config file>
+                                                create an admin and print a link to set its password
+  server users <command> ... <config file>      list, add, import, reset-password, setup-link, disable
+                                                or enable users; run "server users" for details`
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if len(os.Args) != 4 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := server.Migrate(os.Args[3], os.Args[2], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "migrate:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "create-admin" {
+		flags := flag.NewFlagSet("create-admin", flag.ExitOnError)
+		email := flags.String("email", "", "email address of the new admin")
+		flags.Parse(os.Args[2:])
+		if *email == "" || flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := server.CreateAdmin(flags.Arg(0), *email, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "create-admin:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		if err := server.Users(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "users:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(os.Args) != 2 {
 		panic("Expected config file path as command-line argument.")
 	}
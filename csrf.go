@@ -0,0 +1,193 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	csrfCookie    = "csrf_token"
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+
+	// maxFormSize caps form bodies read to find the token. It matches the
+	// limit net/http puts on urlencoded forms, and leaves room for a roster
+	// carried from the preview page to the commit.
+	maxFormSize = 10 << 20
+)
+
+// Templates wraps the parsed templates so that every page rendered with
+// ExecuteTemplate can use {{csrfField}} in its forms.
+type Templates struct {
+	*template.Template
+}
+
+func parseTemplates(pattern string) (*Templates, error) {
+	t, err := template.New("").Funcs(csrfFuncs("")).ParseGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &Templates{t}, nil
+}
+
+// ExecuteTemplate renders a clone of the named template with the CSRF token
+// of the response being written. The parsed set itself is never executed,
+// since html/template can't clone a template after running it.
+func (t *Templates) ExecuteTemplate(w io.Writer, name string, data any) error {
+	var token string
+	if cw, ok := w.(*csrfResponseWriter); ok {
+		token = cw.token
+	}
+	clone, err := t.Template.Clone()
+	if err != nil {
+		return err
+	}
+	return clone.Funcs(csrfFuncs(token)).ExecuteTemplate(w, name, data)
+}
+
+func csrfFuncs(token string) template.FuncMap {
+	return template.FuncMap{
+		"csrfToken": func() string { return token },
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s" />`,
+				csrfFormField, template.HTMLEscapeString(token)))
+		},
+	}
+}
+
+// csrfResponseWriter carries the request's CSRF token to ExecuteTemplate
+type csrfResponseWriter struct {
+	http.ResponseWriter
+	token string
+}
+
+func (w *csrfResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// CSRFProtect gives each browser session a random token in a cookie and
+// rejects state-changing requests that don't echo it back in the
+// X-CSRF-Token header or csrf_token form field. Requests without the header
+// that aren't plain forms, such as JSON and multipart uploads, must instead
+// come from our own origin, so their bodies are left for the handler to
+// read under its own limit. Bearer-token requests are exempt; browsers never
+// send those on their own.
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 64 {
+			token = cookie.Value
+		}
+		if token == "" {
+			var err error
+			if token, err = setCSRFCookie(w, r); err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		cw := &csrfResponseWriter{ResponseWriter: w, token: token}
+
+		if isStateChanging(r.Method) && bearerToken(r) == "" {
+			if err := checkCSRF(w, r, token); err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, "Forbidden: "+err.Error()+". Reload the page and try again.", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// rotateCSRFToken replaces the CSRF token, e.g. when a user signs in or
+// out, so a token planted before login can't be used after it.
+func rotateCSRFToken(w http.ResponseWriter, r *http.Request) {
+	token, err := setCSRFCookie(w, r)
+	if err != nil {
+		return
+	}
+	if cw, ok := w.(*csrfResponseWriter); ok {
+		cw.token = token
+	}
+}
+
+func setCSRFCookie(w http.ResponseWriter, r *http.Request) (string, error) {
+	token, err := generateSecureToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+func isStateChanging(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+func checkCSRF(w http.ResponseWriter, r *http.Request, token string) error {
+	if sent := r.Header.Get(csrfHeader); sent != "" {
+		return compareCSRFToken(sent, token)
+	}
+	if !isFormRequest(r) {
+		return checkSameOrigin(r)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	return compareCSRFToken(r.PostForm.Get(csrfFormField), token)
+}
+
+func compareCSRFToken(sent, token string) error {
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		return fmt.Errorf("invalid or missing CSRF token")
+	}
+	return nil
+}
+
+// isFormRequest reports whether a request has a body we parse for the token.
+// Multipart bodies aren't parsed, since they may be large uploads.
+func isFormRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "" ||
+		strings.HasPrefix(contentType, "application/x-www-form-urlencoded") ||
+		strings.HasPrefix(contentType, "text/plain")
+}
+
+// checkSameOrigin requires the Origin header, or failing that the Referer,
+// to name this host or the host in public_url
+func checkSameOrigin(r *http.Request) error {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return fmt.Errorf("missing Origin header")
+	}
+	u, err := url.Parse(source)
+	if err != nil || !(strings.EqualFold(u.Host, r.Host) || strings.EqualFold(u.Host, publicHost(r))) {
+		return fmt.Errorf("cross-origin request")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+	config = &Config{}
+
+	token := strings.Repeat("ab", 32)
+	form := "application/x-www-form-urlencoded"
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		header      map[string]string
+		want        int
+	}{
+		{"GET needs no token", "GET", "", "", nil, http.StatusOK},
+		{"form with token", "POST", form, "csrf_token=" + token, nil, http.StatusOK},
+		{"form without token", "POST", form, "name=x", nil, http.StatusForbidden},
+		{"form with wrong token", "POST", form, "csrf_token=" + strings.Repeat("cd", 32), nil, http.StatusForbidden},
+		{"header token", "POST", form, "name=x", map[string]string{"X-CSRF-Token": token}, http.StatusOK},
+		{"wrong header token", "POST", form, "csrf_token=" + token, map[string]string{"X-CSRF-Token": "wrong"}, http.StatusForbidden},
+		{"header token on JSON", "DELETE", "application/json", "{}", map[string]string{"X-CSRF-Token": token}, http.StatusOK},
+		{"same-origin JSON", "POST", "application/json", "{}", map[string]string{"Origin": "http://app.test"}, http.StatusOK},
+		{"cross-origin JSON", "POST", "application/json", "{}", map[string]string{"Origin": "http://evil.test"}, http.StatusForbidden},
+		{"cross-origin JSON by Referer", "POST", "application/json", "{}", map[string]string{"Referer": "http://evil.test/page"}, http.StatusForbidden},
+		{"JSON without Origin", "POST", "application/json", "{}", nil, http.StatusForbidden},
+		{"cross-origin multipart", "POST", "multipart/form-data; boundary=x", "--x--", map[string]string{"Origin": "http://evil.test"}, http.StatusForbidden},
+		{"same-origin multipart", "POST", "multipart/form-data; boundary=x", "--x--", map[string]string{"Origin": "http://app.test"}, http.StatusOK},
+		{"bearer token bypass", "POST", "application/json", "{}", map[string]string{"Authorization": "Bearer abc", "Origin": "http://evil.test"}, http.StatusOK},
+		{"form too large", "POST", form, "x=" + strings.Repeat("a", maxFormSize) + "&csrf_token=" + token, nil, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reached bool
+			handler := CSRFProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+
+			req := httptest.NewRequest(tt.method, "http://app.test/admin/update-user", strings.NewReader(tt.body))
+			req.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if reached != (tt.want == http.StatusOK) {
+				t.Errorf("handler reached = %v with status %d", reached, rec.Code)
+			}
+		})
+	}
+}
+
+func TestCSRFProtectSetsCookie(t *testing.T) {
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+	config = &Config{}
+
+	handler := CSRFProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// A first visit gets a token, but can't use it in the same request
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "http://app.test/login", strings.NewReader("")))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("a POST without a cookie got status %d, want 403", rec.Code)
+	}
+	var token string
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == csrfCookie {
+			token = cookie.Value
+		}
+	}
+	if len(token) != 64 {
+		t.Fatalf("got CSRF cookie %q, want a 64-character token", token)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Database drivers, which are also the names of the migration directories
+const (
+	dialectSQLite   = "sqlite3"
+	dialectPostgres = "postgres"
+)
+
+// DB is a database handle that takes "?" placeholders whichever database is
+// behind it, so queries are written once for SQLite and Postgres.
+type DB struct {
+	*sql.DB
+	dialect string
+}
+
+// Tx is a transaction on a DB, with the same placeholder handling
+type Tx struct {
+	*sql.Tx
+	db *DB
+
+	committed []func() // run by Commit once the transaction succeeds
+}
+
+// querier is what DB and Tx have in common, for code that runs either in a
+// transaction or not
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// openDatabase connects to Postgres when db_url is set, and otherwise to
+// the SQLite file at db_path. Several servers can share one Postgres
+// database; a SQLite file belongs to a single server.
+func openDatabase(c ServerConfig) (*DB, error) {
+	driver, source := dialectSQLite, c.DBPath
+	if c.DBURL != "" {
+		driver, source = dialectPostgres, c.DBURL
+	}
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return &DB{DB: db, dialect: driver}, nil
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.rebind(query), args...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, db: db}, nil
+}
+
+// Commit commits the transaction, then runs the functions given to
+// afterCommit
+func (tx *Tx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	for _, fn := range tx.committed {
+		fn()
+	}
+	return nil
+}
+
+// afterCommit arranges for fn to run if the transaction commits, for state
+// kept outside the database that should change along with it
+func (tx *Tx) afterCommit(fn func()) {
+	tx.committed = append(tx.committed, fn)
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.db.rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.db.rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.db.rebind(query), args...)
+}
+
+// rebind turns "?" placeholders into Postgres's "$1", "$2", ... Question
+// marks inside quoted strings are left alone.
+func (db *DB) rebind(query string) string {
+	if db.dialect != dialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			inString = !inString
+		case c == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Emails are rendered from templates/email/<name>.html and <name>.txt, each
+// wrapped in that directory's layout.html and layout.txt. The .txt file also
+// defines the subject.
+const (
+	emailSetup         = "setup"
+	emailPasswordReset = "password-reset"
+	emailLoginLink     = "login-link"
+	emailAnnouncement  = "announcement"
+)
+
+var emailNames = []string{emailSetup, emailPasswordReset, emailLoginLink, emailAnnouncement}
+
+const emailTemplateDir = "templates/email"
+
+type emailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// EmailData is what email templates see. Course, CourseTitle, SenderName
+// and Support come from the site config.
+type EmailData struct {
+	Course      string
+	CourseTitle string
+	SenderName  string
+	Support     string
+	Subject     string // rendered from the "subject" template
+
+	Email      string    // the recipient
+	URL        string    // the link the email is about, if any
+	Expires    string    // how long URL works, e.g. "7 days"
+	LinkExpiry time.Time // when URL stops working; the queued email is cleared then
+
+	// Announcements
+	Title   string
+	Message string // Markdown
+}
+
+// EmailButton is the argument of the layout's "link" template
+type EmailButton struct {
+	URL   string
+	Label string
+}
+
+func (d *EmailData) Button(label string) EmailButton {
+	return EmailButton{URL: d.URL, Label: label}
+}
+
+// MessageHTML renders Message like a site page, without raw HTML
+func (d *EmailData) MessageHTML() htmltemplate.HTML {
+	return htmltemplate.HTML(renderStaffMarkdown([]byte(d.Message)))
+}
+
+func loadEmailTemplates(dir string) (map[string]*emailTemplate, error) {
+	htmlLayout, err := htmltemplate.ParseFiles(filepath.Join(dir, "layout.html"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load email templates: %w", err)
+	}
+	textLayout, err := texttemplate.ParseFiles(filepath.Join(dir, "layout.txt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load email templates: %w", err)
+	}
+
+	templates := make(map[string]*emailTemplate)
+	for _, name := range emailNames {
+		html, err := htmltemplate.Must(htmlLayout.Clone()).ParseFiles(filepath.Join(dir, name+".html"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load email templates: %w", err)
+		}
+		text, err := texttemplate.Must(textLayout.Clone()).ParseFiles(filepath.Join(dir, name+".txt"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load email templates: %w", err)
+		}
+		if text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("email template %s.txt doesn't define a subject", name)
+		}
+		templates[name] = &emailTemplate{html: html, text: text}
+	}
+	return templates, nil
+}
+
+// newEmailData fills in the site config's branding. Sender and support
+// contact default to the course name and "your instructor".
+func newEmailData(to string) *EmailData {
+	data := &EmailData{
+		Course:      config.CourseName,
+		CourseTitle: config.CourseTitle,
+		SenderName:  config.EmailSenderName,
+		Support:     config.SupportContact,
+		Email:       to,
+	}
+	if data.SenderName == "" {
+		data.SenderName = "the " + strings.TrimSpace(data.Course+" course website")
+	}
+	if data.Support == "" {
+		data.Support = "your instructor"
+	}
+	return data
+}
+
+// renderEmail renders the named email for data.Email
+func (am *AuthManager) renderEmail(name string, data *EmailData) (*EmailMessage, error) {
+	t := am.emailTemplates[name]
+	var subject, text, html bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("failed to render %s email subject: %w", name, err)
+	}
+	data.Subject = strings.TrimSpace(subject.String())
+	if err := t.text.ExecuteTemplate(&text, "layout", data); err != nil {
+		return nil, fmt.Errorf("failed to render %s email: %w", name, err)
+	}
+	if err := t.html.ExecuteTemplate(&html, "layout", data); err != nil {
+		return nil, fmt.Errorf("failed to render %s email: %w", name, err)
+	}
+	return &EmailMessage{To: data.Email, Subject: data.Subject, HTML: html.String(), Text: text.String()}, nil
+}
+
+// sendTemplateEmail renders the named email and queues it in the outbox
+func (am *AuthManager) sendTemplateEmail(name string, data *EmailData) error {
+	msg, err := am.renderEmail(name, data)
+	if err != nil {
+		return err
+	}
+	return am.QueueEmail(msg, data.LinkExpiry)
+}
+
+func (am *AuthManager) SendSetupEmail(user *User, baseURL string) error {
+	setupURL := fmt.Sprintf("%s/setup?token=%s", baseURL, user.SetupToken)
+
+	// For development, log the setup URL
+	log.Printf("Setup email for %s: %s", user.Email, setupURL)
+
+	data := newEmailData(user.Email)
+	data.URL = setupURL
+	data.Expires = describeDuration(setupTokenLifetime())
+	data.LinkExpiry = time.Now().Add(setupTokenLifetime())
+	return am.sendTemplateEmail(emailSetup, data)
+}
+
+// SendPasswordResetEmail sends a user who has already set up their account
+// the link from a new setup token, for choosing a new password
+func (am *AuthManager) SendPasswordResetEmail(user *User, baseURL string) error {
+	resetURL := fmt.Sprintf("%s/setup?token=%s", baseURL, user.SetupToken)
+
+	// For development, log the reset URL
+	log.Printf("Password reset email for %s: %s", user.Email, resetURL)
+
+	data := newEmailData(user.Email)
+	data.URL = resetURL
+	data.Expires = describeDuration(setupTokenLifetime())
+	data.LinkExpiry = time.Now().Add(setupTokenLifetime())
+	return am.sendTemplateEmail(emailPasswordReset, data)
+}
+
+// announcementData is the data for a message written by staff in Markdown
+func announcementData(to, title, message string) *EmailData {
+	data := newEmailData(to)
+	data.Title = title
+	data.Message = message
+	return data
+}
+
+// SendAnnouncementEmail sends a message written by staff in Markdown. The
+// plain-text part is the Markdown itself.
+func (am *AuthManager) SendAnnouncementEmail(to, title, message string) error {
+	return am.sendTemplateEmail(emailAnnouncement, announcementData(to, title, message))
+}
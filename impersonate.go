@@ -0,0 +1,170 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Holds the admin's own session while they view the site as someone else
+	impersonatorCookie = "impersonator_token"
+
+	impersonationDuration = time.Hour
+)
+
+// GenerateImpersonationJWT issues a short session for user on behalf of
+// admin. RequireAuth rejects state-changing requests made with it.
+func (am *AuthManager) GenerateImpersonationJWT(user, admin *User) (string, error) {
+	claims := AuthClaims{
+		UserID:         user.ID,
+		Email:          user.Email,
+		IsAdmin:        user.IsAdmin,
+		ImpersonatedBy: admin.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(impersonationDuration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			NotBefore: jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(am.jwtSecret)
+}
+
+// Start viewing the site as another user. The admin's session is set aside
+// in a cookie and restored by handleStopImpersonating.
+func handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	if !userClaims.IsAdmin {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	user, err := authManager.GetUserByID(userID)
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusBadRequest)
+		return
+	}
+
+	// Viewing as an admin would hand out their access, not show a student's
+	// view of the site
+	switch {
+	case user.ID == userClaims.UserID:
+		redirectManageUsers(w, r, "error", "You can't view the site as yourself")
+		return
+	case user.IsAdmin:
+		redirectManageUsers(w, r, "error", "You can't view the site as another administrator")
+		return
+	case user.Disabled:
+		redirectManageUsers(w, r, "error", user.Email+" is disabled")
+		return
+	}
+
+	adminCookie, err := r.Cookie("auth_token")
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	admin, err := authManager.GetUserByID(userClaims.UserID)
+	if err != nil || admin == nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	token, err := authManager.GenerateImpersonationJWT(user, admin)
+	if err != nil {
+		panicf("Error generating impersonation token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     impersonatorCookie,
+		Value:    adminCookie.Value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(impersonationDuration.Seconds()),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_token",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(impersonationDuration.Seconds()),
+	})
+
+	authManager.Audit(r, AuditImpersonate, user.Email, "started")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Return to the admin's own session. This route isn't behind RequireAuth,
+// since that refuses POSTs from impersonation sessions.
+func handleStopImpersonating(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie("auth_token")
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	claims, err := authManager.ValidateJWT(cookie.Value)
+	if err != nil || claims.ImpersonatedBy == 0 {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: impersonatorCookie, Value: "", Path: "/", HttpOnly: true, Secure: isHTTPS(r), MaxAge: -1})
+
+	// Only restore a session that belongs to the admin who started this
+	var adminClaims *AuthClaims
+	if adminCookie, err := r.Cookie(impersonatorCookie); err == nil {
+		adminClaims, err = authManager.ValidateJWT(adminCookie.Value)
+		if err != nil || adminClaims.UserID != claims.ImpersonatedBy || adminClaims.ImpersonatedBy != 0 {
+			adminClaims = nil
+		} else {
+			http.SetCookie(w, &http.Cookie{
+				Name:     "auth_token",
+				Value:    adminCookie.Value,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   isHTTPS(r),
+				SameSite: http.SameSiteLaxMode,
+				MaxAge:   int(time.Until(adminClaims.ExpiresAt.Time).Seconds()),
+			})
+		}
+	}
+
+	var adminEmail string
+	if admin, err := authManager.GetUserByID(claims.ImpersonatedBy); err == nil && admin != nil {
+		adminEmail = admin.Email
+	}
+	authManager.AuditAs(r, claims.ImpersonatedBy, adminEmail, AuditImpersonate, claims.Email, "stopped")
+
+	if adminClaims == nil {
+		http.SetCookie(w, &http.Cookie{Name: "auth_token", Value: "", Path: "/", HttpOnly: true, Secure: isHTTPS(r), MaxAge: -1})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/admin/manage-users", http.StatusSeeOther)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig configures password checks against an LDAP directory, set in
+// the [ldap] table of the server config. Local passwords still work for
+// anyone the directory rejects.
+type LDAPConfig struct {
+	URL                string   `toml:"url"`                  // ldap://host:389 or ldaps://host:636
+	BindDN             string   `toml:"bind_dn"`              // e.g. "uid={username},ou=people,dc=example,dc=edu"
+	StartTLS           bool     `toml:"start_tls"`            // upgrade ldap:// connections
+	InsecureSkipVerify bool     `toml:"insecure_skip_verify"` // for test directories only
+	TimeoutSeconds     int      `toml:"timeout_seconds"`      // defaults to 10
+	GroupAttribute     string   `toml:"group_attribute"`      // defaults to "memberOf"
+	AdminGroups        []string `toml:"admin_groups"`         // group DNs; if set, membership decides IsAdmin
+	AutoProvision      bool     `toml:"auto_provision"`       // create users unknown to the users table
+	EmailAttribute     string   `toml:"email_attribute"`      // defaults to "mail"
+	EmailDomain        string   `toml:"email_domain"`         // if set, only addresses at this domain are tried
+}
+
+func (c LDAPConfig) Enabled() bool {
+	return c.URL != "" && c.BindDN != ""
+}
+
+// ldapAuthenticator binds to the directory as the user. The bind DN comes
+// from a template where {email} is the full address and {username} the
+// part before the "@". Since {username} drops the domain, the address typed
+// must also be one of the entry's email attributes before it is matched to a
+// local account; entries without one are only accepted when email_domain is
+// set, as then the domain was checked before binding.
+type ldapAuthenticator struct {
+	am  *AuthManager
+	cfg LDAPConfig
+}
+
+func (a *ldapAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (a *ldapAuthenticator) Authenticate(email, password string) (*User, error) {
+	// An empty password is an unauthenticated bind, which most directories
+	// accept without checking anything
+	if password == "" || email == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if a.cfg.EmailDomain != "" {
+		_, domain, _ := strings.Cut(email, "@")
+		if !strings.EqualFold(domain, a.cfg.EmailDomain) {
+			return nil, ErrInvalidCredentials
+		}
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	defer conn.Close()
+
+	dn := a.bindDN(email)
+	if err := conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("LDAP bind failed: %w", err)
+	}
+
+	entry, err := a.readEntry(conn, dn)
+	if err != nil {
+		return nil, err
+	}
+	mails := entry.GetAttributeValues(a.emailAttribute())
+	if len(mails) > 0 {
+		found := false
+		for _, mail := range mails {
+			if strings.EqualFold(mail, email) {
+				email, found = mail, true
+				break
+			}
+		}
+		if !found {
+			log.Printf("LDAP entry %s doesn't have the address %s", dn, email)
+			return nil, ErrInvalidCredentials
+		}
+	} else if a.cfg.EmailDomain == "" {
+		log.Printf("LDAP entry %s has no %s attribute; set email_domain to accept it", dn, a.emailAttribute())
+		return nil, ErrInvalidCredentials
+	}
+	isAdmin, groupsDecide := a.adminFromGroups(entry)
+
+	user, err := a.am.GetUserByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if !a.cfg.AutoProvision {
+			return nil, fmt.Errorf("no account for %s", email)
+		}
+		user, err = a.am.CreateUser(email, isAdmin)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Provisioned user %s from LDAP login", email)
+	}
+
+	// The directory vouches for the user, so the setup email flow is not needed
+	if !user.IsSetup {
+		if err := a.am.MarkUserSetup(user.ID); err != nil {
+			return nil, err
+		}
+		user.IsSetup = true
+	}
+
+	if groupsDecide && user.IsAdmin != isAdmin {
+		err := a.am.SetUserAdmin(user.ID, isAdmin)
+		if err == ErrLastAdmin {
+			log.Printf("Not removing admin from %s: they are the last admin", user.Email)
+		} else if err != nil {
+			return nil, err
+		} else {
+			user.IsAdmin = isAdmin
+		}
+	}
+
+	return user, nil
+}
+
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	timeout := time.Duration(a.cfg.TimeoutSeconds) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.cfg.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(a.cfg.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+
+	if a.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *ldapAuthenticator) bindDN(email string) string {
+	username, _, _ := strings.Cut(email, "@")
+	return strings.NewReplacer(
+		"{email}", ldap.EscapeDN(email),
+		"{username}", ldap.EscapeDN(username),
+	).Replace(a.cfg.BindDN)
+}
+
+func (a *ldapAuthenticator) emailAttribute() string {
+	if a.cfg.EmailAttribute == "" {
+		return "mail"
+	}
+	return a.cfg.EmailAttribute
+}
+
+func (a *ldapAuthenticator) groupAttribute() string {
+	if a.cfg.GroupAttribute == "" {
+		return "memberOf"
+	}
+	return a.cfg.GroupAttribute
+}
+
+// readEntry reads the bound user's email addresses and group memberships
+func (a *ldapAuthenticator) readEntry(conn *ldap.Conn, dn string) (*ldap.Entry, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", []string{a.emailAttribute(), a.groupAttribute()}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP entry lookup failed: %w", err)
+	}
+	if len(result.Entries) == 0 {
+		return &ldap.Entry{DN: dn}, nil
+	}
+	return result.Entries[0], nil
+}
+
+// adminFromGroups reports whether any of the entry's groups is an admin
+// group, and whether group mapping is configured.
+func (a *ldapAuthenticator) adminFromGroups(entry *ldap.Entry) (isAdmin bool, configured bool) {
+	if len(a.cfg.AdminGroups) == 0 {
+		return false, false
+	}
+	for _, group := range entry.GetAttributeValues(a.groupAttribute()) {
+		for _, admin := range a.cfg.AdminGroups {
+			if strings.EqualFold(group, admin) {
+				return true, true
+			}
+		}
+	}
+	return false, true
+}
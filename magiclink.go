@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	loginLinkExpiry   = 15 * time.Minute
+	loginLinkCooldown = time.Minute // between links sent to one user
+)
+
+type LoginLinkPage struct {
+	Token string
+}
+
+// CreateLoginToken issues a single-use sign-in token for user. Only its
+// SHA-256 hash is stored. It returns "" without error if a link was sent
+// to the user very recently, so the form can't be used to flood an inbox.
+func (am *AuthManager) CreateLoginToken(user *User) (string, error) {
+	var recent int
+	err := am.db.QueryRow(`
+		SELECT COUNT(*) FROM login_tokens WHERE user_id = ? AND created_at > ?
+	`, user.ID, time.Now().Add(-loginLinkCooldown)).Scan(&recent)
+	if err != nil {
+		return "", err
+	}
+	if recent > 0 {
+		return "", nil
+	}
+
+	token, err := generateSecureToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate login token: %w", err)
+	}
+
+	_, err = am.db.Exec(`
+		INSERT INTO login_tokens (user_id, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?)
+	`, user.ID, hashToken(token), time.Now().Add(loginLinkExpiry), time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to store login token: %w", err)
+	}
+	return token, nil
+}
+
+// ConsumeLoginToken marks the token used and returns its user. A token can
+// only ever be consumed once.
+func (am *AuthManager) ConsumeLoginToken(token string) (*User, error) {
+	hash := hashToken(token)
+	result, err := am.db.Exec(`
+		UPDATE login_tokens SET used_at = ?
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, time.Now(), hash, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return nil, fmt.Errorf("invalid or expired login link")
+	}
+
+	var userID int
+	err = am.db.QueryRow(`SELECT user_id FROM login_tokens WHERE token_hash = ?`, hash).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("invalid or expired login link")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := am.GetUserByID(userID)
+	if err != nil || user == nil {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	// Following the emailed link proves ownership of the address
+	if !user.IsSetup {
+		if err := am.MarkUserSetup(user.ID); err != nil {
+			return nil, err
+		}
+		user.IsSetup = true
+	}
+	return user, nil
+}
+
+func (am *AuthManager) SendLoginLinkEmail(user *User, token, baseURL string) error {
+	loginURL := fmt.Sprintf("%s/login/link?token=%s", baseURL, token)
+
+	// For development, log the login URL
+	log.Printf("Login link for %s: %s", user.Email, loginURL)
+
+	data := newEmailData(user.Email)
+	data.URL = loginURL
+	data.Expires = fmt.Sprintf("%d minutes", int(loginLinkExpiry.Minutes()))
+	data.LinkExpiry = time.Now().Add(loginLinkExpiry)
+	return am.sendTemplateEmail(emailLoginLink, data)
+}
+
+// Passwordless login: POST an email to get a link, GET the link to see a
+// confirmation page, POST the token to sign in. The extra confirmation step
+// stops mail scanners that prefetch links from using up the token.
+func handleLoginLink(w http.ResponseWriter, r *http.Request) {
+	if !config.MagicLinkLogin {
+		notFound(w, "Email sign-in links are not enabled")
+		return
+	}
+
+	if r.Method == "GET" {
+		page := LoginLinkPage{Token: r.URL.Query().Get("token")}
+		if page.Token == "" {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if err := config.templates.ExecuteTemplate(w, "login-link.html", page); err != nil {
+			panicf("Error executing login link template: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if token := r.FormValue("token"); token != "" {
+		user, err := authManager.ConsumeLoginToken(token)
+		if err != nil {
+			renderLoginPage(w, LoginPage{Error: "That sign-in link is invalid or has expired. Please request a new one."})
+			return
+		}
+		completeLogin(w, r, user, "email link")
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	// Always show the same message so the form doesn't reveal who has an account
+	notice := "If an account exists for " + email + ", a sign-in link is on its way. Check your email."
+
+	user, err := authManager.GetUserByEmail(email)
+	if err != nil {
+		panicf("Error looking up user: %v", err)
+	}
+	if user != nil && !user.Disabled {
+		token, err := authManager.CreateLoginToken(user)
+		if err != nil {
+			panicf("Error creating login token: %v", err)
+		}
+		if token != "" {
+			if err := authManager.SendLoginLinkEmail(user, token, baseURL(r)); err != nil {
+				log.Printf("Error queueing login link email to %s: %v", user.Email, err)
+			}
+		}
+	}
+
+	renderLoginPage(w, LoginPage{Notice: notice, Email: email})
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
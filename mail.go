@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EmailMessage is one outgoing email. Text is an optional plain-text
+// alternative to HTML.
+type EmailMessage struct {
+	To      string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Mailer delivers email. The [mail] table of the server config picks one.
+type Mailer interface {
+	Send(msg *EmailMessage) error
+}
+
+// MailConfig is the [mail] table of the server config:
+//
+//	[mail]
+//	backend = "smtp"          # "resend", "smtp", "sendmail", "file" or "log"
+//	from = "COMP 3007 <noreply@example.ca>"
+//	smtp_host = "smtp.example.ca"
+//	smtp_port = 587
+//	smtp_username = "noreply"
+//	smtp_password = "secret"
+//	smtp_tls = "starttls"     # "starttls" (default), "tls" or "none"
+//	rate_per_minute = 60      # how fast queued email is sent
+//	max_attempts = 8          # before a message is marked failed
+//
+// Without a backend, Resend is used if resend_api_key (or RESEND_API_KEY)
+// is set, and emails are only logged otherwise.
+type MailConfig struct {
+	Backend string `toml:"backend"`
+	From    string `toml:"from"`
+
+	SMTPHost     string `toml:"smtp_host"`
+	SMTPPort     int    `toml:"smtp_port"`
+	SMTPUsername string `toml:"smtp_username"`
+	SMTPPassword string `toml:"smtp_password"`
+	SMTPTLS      string `toml:"smtp_tls"`
+
+	SendmailPath string `toml:"sendmail_path"` // defaults to /usr/sbin/sendmail
+	Dir          string `toml:"dir"`           // where the file backend writes .eml files
+
+	// Delivery from the outbox; see outbox.go
+	RatePerMinute int `toml:"rate_per_minute"`
+	MaxAttempts   int `toml:"max_attempts"`
+}
+
+const (
+	mailTimeout = 30 * time.Second
+
+	// Resend's test domain, for when no sender is configured
+	defaultResendFrom = "onboarding@resend.dev"
+)
+
+// newMailer builds the mailer chosen in the server config. senderName, from
+// the site config, names a from address that has no name of its own.
+func newMailer(c ServerConfig, senderName string) (Mailer, error) {
+	mc := c.Mail
+	apiKey := c.ResendApiKey
+	if apiKey == "" {
+		apiKey = os.Getenv("RESEND_API_KEY")
+	}
+	from := mc.From
+	if from == "" {
+		from = c.ResendFromEmail
+	}
+	if from == "" {
+		from = os.Getenv("FROM_EMAIL")
+	}
+
+	backend := mc.Backend
+	if backend == "" {
+		backend = "log"
+		if apiKey != "" {
+			backend = "resend"
+		}
+	}
+	if backend != "resend" && backend != "log" {
+		if from == "" {
+			return nil, fmt.Errorf("mail backend %s needs a from address", backend)
+		}
+		if _, err := mail.ParseAddress(from); err != nil {
+			return nil, fmt.Errorf("bad mail from address %q: %w", from, err)
+		}
+	}
+	if addr, err := mail.ParseAddress(from); err == nil && addr.Name == "" && senderName != "" {
+		addr.Name = senderName
+		from = addr.String()
+	}
+
+	switch backend {
+	case "resend":
+		if apiKey == "" {
+			return nil, fmt.Errorf("mail backend resend needs resend_api_key")
+		}
+		if from == "" {
+			from = defaultResendFrom
+		}
+		return &resendMailer{apiKey: apiKey, from: from}, nil
+
+	case "smtp":
+		if mc.SMTPHost == "" {
+			return nil, fmt.Errorf("mail backend smtp needs smtp_host")
+		}
+		m := &smtpMailer{host: mc.SMTPHost, port: mc.SMTPPort, username: mc.SMTPUsername,
+			password: mc.SMTPPassword, security: mc.SMTPTLS, from: from}
+		if m.security == "" {
+			m.security = "starttls"
+		}
+		if m.security != "starttls" && m.security != "tls" && m.security != "none" {
+			return nil, fmt.Errorf("smtp_tls must be starttls, tls or none, got %q", m.security)
+		}
+		if m.port == 0 {
+			m.port = 587
+			if m.security == "tls" {
+				m.port = 465
+			}
+		}
+		return m, nil
+
+	case "sendmail":
+		path := mc.SendmailPath
+		if path == "" {
+			path = "/usr/sbin/sendmail"
+		}
+		return &sendmailMailer{path: path, from: from}, nil
+
+	case "file":
+		if mc.Dir == "" {
+			return nil, fmt.Errorf("mail backend file needs dir")
+		}
+		if err := os.MkdirAll(mc.Dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create mail dir: %w", err)
+		}
+		return &fileMailer{dir: mc.Dir, from: from}, nil
+
+	case "log":
+		return logMailer{}, nil
+	}
+	return nil, fmt.Errorf("unknown mail backend %q", backend)
+}
+
+// logMailer only logs who each email is for, for development without a
+// mail server. The file backend keeps whole messages.
+type logMailer struct{}
+
+func (logMailer) Send(msg *EmailMessage) error {
+	log.Printf("Email not sent (no mail backend configured) to %s: %s", msg.To, msg.Subject)
+	return nil
+}
+
+// ResendEmailRequest represents the JSON payload for Resend API
+type ResendEmailRequest struct {
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Html    string   `json:"html"`
+	Text    string   `json:"text,omitempty"`
+}
+
+// ResendEmailResponse represents the response from Resend API
+type ResendEmailResponse struct {
+	Id string `json:"id"`
+}
+
+type resendMailer struct {
+	apiKey string
+	from   string
+}
+
+func (m *resendMailer) Send(msg *EmailMessage) error {
+	emailRequest := ResendEmailRequest{
+		From:    m.from,
+		To:      []string{msg.To},
+		Subject: msg.Subject,
+		Html:    msg.HTML,
+		Text:    msg.Text,
+	}
+	jsonData, err := json.Marshal(emailRequest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal email request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", "https://api.resend.com/emails", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: mailTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Resend API returned status %d: %s - %s", resp.StatusCode, resp.Status, string(bodyBytes))
+	}
+
+	var emailResponse ResendEmailResponse
+	if err := json.NewDecoder(resp.Body).Decode(&emailResponse); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	log.Printf("Email sent successfully to %s via Resend API (ID: %s)", msg.To, emailResponse.Id)
+	return nil
+}
+
+type smtpMailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	security string // "starttls", "tls" or "none"
+	from     string
+}
+
+func (m *smtpMailer) Send(msg *EmailMessage) error {
+	data, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	tlsConfig := &tls.Config{ServerName: m.host}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: mailTimeout}
+	if m.security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP server %s: %w", addr, err)
+	}
+	defer c.Close()
+
+	if m.security == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server %s doesn't offer STARTTLS; set smtp_tls if that's expected", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("SMTP STARTTLS failed: %w", err)
+		}
+	}
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := c.Mail(envelopeAddress(m.from)); err != nil {
+		return fmt.Errorf("SMTP MAIL FROM failed: %w", err)
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("SMTP RCPT TO %s failed: %w", msg.To, err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA failed: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("SMTP server rejected message: %w", err)
+	}
+	return c.Quit()
+}
+
+type sendmailMailer struct {
+	path string
+	from string
+}
+
+func (m *sendmailMailer) Send(msg *EmailMessage) error {
+	data, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+	// -i: a line with a single dot doesn't end the message
+	cmd := exec.Command(m.path, "-i", "-f", envelopeAddress(m.from), "--", msg.To)
+	cmd.Stdin = bytes.NewReader(data)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sendmail failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// fileMailer writes each email to a .eml file, for testing and for
+// inspecting what would be sent
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (m *fileMailer) Send(msg *EmailMessage) error {
+	data, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+	log.Printf("Email to %s written to %s", msg.To, path)
+	return nil
+}
+
+// envelopeAddress is the bare address in a From header such as
+// "COMP 3007 <noreply@example.ca>"
+func envelopeAddress(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return addr.Address
+	}
+	return from
+}
+
+// buildMessage formats msg as a MIME message, with a plain-text part when
+// msg.Text is set
+func buildMessage(from string, msg *EmailMessage) ([]byte, error) {
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return nil, fmt.Errorf("invalid recipient %q", msg.To)
+	}
+	messageID := make([]byte, 16)
+	rand.Read(messageID)
+	domain := "localhost"
+	if _, d, ok := strings.Cut(envelopeAddress(from), "@"); ok {
+		domain = d
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(messageID), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.Text == "" {
+		b.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&b, msg.HTML); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
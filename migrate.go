@@ -0,0 +1,329 @@
+package server
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Schema changes live in migrations/<driver>/NNNN_description.sql, one
+// directory per database, and are applied in order, each in its own
+// transaction. Every change needs a migration of the same version for each
+// database. Never edit a migration once it has been released; add a new one
+// instead.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationState is a migration and when it was applied, if it has been
+type MigrationState struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time // zero if pending
+}
+
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s must start with a version number", entry.Name())
+		}
+		data, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{Version: version, Name: name, SQL: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence; expected version %d", m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// appliedMigrations returns when each applied version was applied, creating
+// the schema_migrations table if needed
+func appliedMigrations(db *DB) (map[int]time.Time, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// migrationStatus lists every known migration and whether it has been applied
+func migrationStatus(db *DB) ([]MigrationState, error) {
+	migrations, err := loadMigrations(db.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchemaVersion(applied, migrations); err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i] = MigrationState{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version]}
+	}
+	return states, nil
+}
+
+// checkSchemaVersion refuses databases migrated by a newer server, whose
+// schema this one doesn't know how to use
+func checkSchemaVersion(applied map[int]time.Time, migrations []migration) error {
+	for version := range applied {
+		if version > len(migrations) {
+			return fmt.Errorf("database schema version %d is newer than this server supports (%d); upgrade the server",
+				version, len(migrations))
+		}
+	}
+	return nil
+}
+
+// migrateUp applies every pending migration and returns the ones it ran
+func migrateUp(db *DB) ([]migration, error) {
+	migrations, err := loadMigrations(db.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchemaVersion(applied, migrations); err != nil {
+		return nil, err
+	}
+
+	if len(applied) == 0 && db.dialect == dialectSQLite {
+		if err := upgradeLegacySchema(db); err != nil {
+			return nil, fmt.Errorf("failed to upgrade database from before migrations: %w", err)
+		}
+	}
+
+	var ran []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return ran, fmt.Errorf("migration %s failed: %w", m.Name, err)
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+func applyMigration(db *DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.Version, m.Name, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// upgradeLegacySchema brings a SQLite database created before migrations
+// existed up to the point where 0001_initial_schema applies cleanly. It does
+// nothing to a new, empty database.
+func upgradeLegacySchema(db *DB) error {
+	exists, err := tableExists(db, "users")
+	if err != nil || !exists {
+		return err
+	}
+
+	// Columns added to users before migrations existed
+	for _, column := range [][2]string{
+		{"is_disabled", "BOOLEAN DEFAULT FALSE"},
+		{"name", "TEXT"},
+		{"student_number", "TEXT"},
+		{"section", "TEXT"},
+		{"preferred_name", "TEXT"},
+		{"pronouns", "TEXT"},
+		{"setup_token_hash", "TEXT"},
+	} {
+		if err := addColumnIfMissing(db, "users", column[0], column[1]); err != nil {
+			return err
+		}
+	}
+	return hashLegacySetupTokens(db)
+}
+
+func tableExists(db *DB, table string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&count)
+	return count > 0, err
+}
+
+func addColumnIfMissing(db *DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// hashLegacySetupTokens moves setup tokens stored in plaintext by older
+// versions into setup_token_hash, so links already emailed keep working
+func hashLegacySetupTokens(db *DB) error {
+	rows, err := db.Query(`SELECT id, setup_token FROM users WHERE setup_token IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	tokens := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, token := range tokens {
+		_, err := db.Exec(`UPDATE users SET setup_token_hash = ?, setup_token = NULL WHERE id = ?`, hashToken(token), id)
+		if err != nil {
+			return fmt.Errorf("failed to hash setup token: %w", err)
+		}
+	}
+	return nil
+}
+
+// Migrate runs the "migrate" command: "status" lists the migrations and
+// which have been applied, "up" applies the pending ones. The server also
+// applies them itself when it starts.
+func Migrate(serverConfigFile, command string, out io.Writer) error {
+	var serverConfig ServerConfig
+	if _, err := toml.DecodeFile(serverConfigFile, &serverConfig); err != nil {
+		return fmt.Errorf("bad server config file %s: %w", serverConfigFile, err)
+	}
+	db, err := openDatabase(serverConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch command {
+	case "status":
+		states, err := migrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			status := "pending"
+			if !state.AppliedAt.IsZero() {
+				status = "applied " + state.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(out, "%-40s %s\n", state.Name, status)
+		}
+		return nil
+
+	case "up":
+		ran, err := migrateUp(db)
+		for _, m := range ran {
+			fmt.Fprintf(out, "Applied %s\n", m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(ran) == 0 {
+			fmt.Fprintln(out, "Database schema is up to date")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q; expected status or up", command)
+}
+
+// migrate brings the database schema up to date at startup
+func (am *AuthManager) migrate() error {
+	ran, err := migrateUp(am.db)
+	for _, m := range ran {
+		log.Printf("Applied database migration %s", m.Name)
+	}
+	return err
+}
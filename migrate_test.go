@@ -0,0 +1,65 @@
+package server
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashLegacySetupTokens(t *testing.T) {
+	// A users table from before migrations, holding a plaintext token
+	const token = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	path := filepath.Join(t.TempDir(), "users.db")
+	legacy, err := sql.Open(dialectSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT UNIQUE NOT NULL,
+			password TEXT,
+			is_admin BOOLEAN DEFAULT FALSE,
+			setup_token TEXT,
+			setup_token_expiry DATETIME,
+			is_setup BOOLEAN DEFAULT FALSE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO users (email, setup_token, setup_token_expiry) VALUES ('pending@example.edu', ?, ?);
+	`, token, time.Now().Add(time.Hour))
+	legacy.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setupTest(t, ServerConfig{DBPath: path})
+
+	var count int
+	if err := authManager.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('users') WHERE name = 'setup_token'`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("the plaintext setup_token column is still there")
+	}
+	var hash string
+	if err := authManager.db.QueryRow(`SELECT setup_token_hash FROM users`).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if hash != hashToken(token) {
+		t.Errorf("setup_token_hash = %q, want the token's hash", hash)
+	}
+
+	// What's stored now can't be used as a token, but the emailed link
+	// still works, once
+	if err := authManager.SetupUserPassword(hash, testPassword); err == nil {
+		t.Error("the stored hash was accepted as a setup token")
+	}
+	if err := authManager.SetupUserPassword(token, testPassword); err != nil {
+		t.Fatalf("the migrated token was rejected: %v", err)
+	}
+	if err := authManager.SetupUserPassword(token, testPassword); err == nil {
+		t.Error("the migrated token was accepted twice")
+	}
+}
@@ -0,0 +1,112 @@
+-- The Postgres version of the schema as it stood when migrations were
+-- introduced. Postgres support arrived after setup tokens were hashed, so
+-- there is no plaintext setup_token column to drop.
+
+CREATE TABLE users (
+	id SERIAL PRIMARY KEY,
+	email TEXT UNIQUE NOT NULL,
+	password TEXT,
+	is_admin BOOLEAN DEFAULT FALSE,
+	setup_token_hash TEXT,
+	setup_token_expiry TIMESTAMPTZ,
+	is_setup BOOLEAN DEFAULT FALSE,
+	is_disabled BOOLEAN DEFAULT FALSE,
+	name TEXT,
+	preferred_name TEXT,
+	student_number TEXT,
+	pronouns TEXT,
+	section TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE FUNCTION set_updated_at() RETURNS trigger AS $$
+BEGIN
+	NEW.updated_at = CURRENT_TIMESTAMP;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER update_users_updated_at
+	BEFORE UPDATE ON users
+	FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+CREATE TABLE user_totp (
+	user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	secret TEXT NOT NULL,
+	enabled BOOLEAN DEFAULT FALSE,
+	last_used_step BIGINT DEFAULT 0,
+	failed_attempts INTEGER DEFAULT 0,
+	locked_until TIMESTAMPTZ,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE totp_recovery_codes (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	used_at TIMESTAMPTZ
+);
+
+CREATE TABLE login_tokens (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	token_hash TEXT UNIQUE NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	used_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE api_tokens (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	token_hash TEXT UNIQUE NOT NULL,
+	scopes TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMPTZ,
+	expires_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ
+);
+
+CREATE TABLE roles (
+	id SERIAL PRIMARY KEY,
+	name TEXT UNIQUE NOT NULL,
+	description TEXT
+);
+
+CREATE TABLE role_permissions (
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	permission TEXT NOT NULL,
+	PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE user_roles (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, role_id)
+);
+
+-- Append-only: actor_email is kept so entries survive the user being deleted
+CREATE TABLE audit_log (
+	id SERIAL PRIMARY KEY,
+	created_at TIMESTAMPTZ NOT NULL,
+	actor_id INTEGER,
+	actor_email TEXT,
+	action TEXT NOT NULL,
+	target TEXT,
+	details TEXT,
+	ip TEXT
+);
+
+CREATE INDEX audit_log_created_at ON audit_log(created_at);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_change
+	BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
@@ -0,0 +1,3 @@
+-- Kept in step with the SQLite migration of the same version. Postgres
+-- databases never had the plaintext column, so only the index is added.
+CREATE INDEX users_setup_token_hash ON users(setup_token_hash);
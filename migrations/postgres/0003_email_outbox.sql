@@ -0,0 +1,17 @@
+-- Outgoing email, queued for the background worker. Bodies are cleared once
+-- a message is sent, since they can hold setup and sign-in links.
+CREATE TABLE email_outbox (
+	id SERIAL PRIMARY KEY,
+	recipient TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	html TEXT NOT NULL,
+	text TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending', -- pending, sent or failed
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	sent_at TIMESTAMPTZ
+);
+
+CREATE INDEX email_outbox_due ON email_outbox(status, next_attempt_at);
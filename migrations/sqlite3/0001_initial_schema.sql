@@ -0,0 +1,111 @@
+-- The schema as it stood when migrations were introduced. Tables are
+-- created only if missing, since databases from before then already have
+-- most of them.
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT UNIQUE NOT NULL,
+	password TEXT,
+	is_admin BOOLEAN DEFAULT FALSE,
+	setup_token TEXT, -- plaintext, from before setup_token_hash; dropped by 0002
+	setup_token_hash TEXT,
+	setup_token_expiry DATETIME,
+	is_setup BOOLEAN DEFAULT FALSE,
+	is_disabled BOOLEAN DEFAULT FALSE,
+	name TEXT,
+	preferred_name TEXT,
+	student_number TEXT,
+	pronouns TEXT,
+	section TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER IF NOT EXISTS update_users_updated_at
+	AFTER UPDATE ON users
+	FOR EACH ROW
+	BEGIN
+		UPDATE users SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;
+
+CREATE TABLE IF NOT EXISTS user_totp (
+	user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	secret TEXT NOT NULL,
+	enabled BOOLEAN DEFAULT FALSE,
+	last_used_step INTEGER DEFAULT 0,
+	failed_attempts INTEGER DEFAULT 0,
+	locked_until DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS login_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	token_hash TEXT UNIQUE NOT NULL,
+	expires_at DATETIME NOT NULL,
+	used_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	token_hash TEXT UNIQUE NOT NULL,
+	scopes TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_used_at DATETIME,
+	expires_at DATETIME,
+	revoked_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE NOT NULL,
+	description TEXT
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	permission TEXT NOT NULL,
+	PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, role_id)
+);
+
+-- Append-only: actor_email is kept so entries survive the user being deleted
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at DATETIME NOT NULL,
+	actor_id INTEGER,
+	actor_email TEXT,
+	action TEXT NOT NULL,
+	target TEXT,
+	details TEXT,
+	ip TEXT
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log(created_at);
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update
+	BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END;
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete
+	BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END;
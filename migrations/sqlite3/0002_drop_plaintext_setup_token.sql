@@ -0,0 +1,5 @@
+-- Setup tokens are stored hashed in setup_token_hash. Plaintext tokens in
+-- older databases are hashed before the first migration runs.
+ALTER TABLE users DROP COLUMN setup_token;
+
+CREATE INDEX IF NOT EXISTS users_setup_token_hash ON users(setup_token_hash);
@@ -0,0 +1,13 @@
+-- Messages sent from the compose page. sender_email and audience are kept
+-- as text so the history survives users and roles being deleted.
+CREATE TABLE bulk_emails (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	sender_id INTEGER,
+	sender_email TEXT NOT NULL,
+	audience TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	body TEXT NOT NULL, -- Markdown
+	recipients INTEGER NOT NULL,
+	failed INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL
+);
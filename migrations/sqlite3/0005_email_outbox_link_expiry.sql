@@ -0,0 +1,4 @@
+-- When the setup or sign-in link in a queued email stops working. The
+-- bodies of these messages are cleared once they are sent, fail for good or
+-- outlive the link, so links aren't kept in the outbox.
+ALTER TABLE email_outbox ADD COLUMN link_expires_at DATETIME;
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig configures single sign-on through an OpenID Connect identity
+// provider, set in the [oidc] table of the server config. Login is matched
+// to the users table by email address.
+type OIDCConfig struct {
+	Issuer        string   `toml:"issuer"`
+	ClientID      string   `toml:"client_id"`
+	ClientSecret  string   `toml:"client_secret"`
+	RedirectURL   string   `toml:"redirect_url"`   // defaults to <host>/auth/oidc/callback
+	ButtonLabel   string   `toml:"button_label"`   // defaults to "Sign in with SSO"
+	AutoProvision bool     `toml:"auto_provision"` // create users unknown to the users table
+	GroupsClaim   string   `toml:"groups_claim"`   // defaults to "groups"
+	AdminGroups   []string `toml:"admin_groups"`   // if set, membership decides IsAdmin at each login
+
+	// ID tokens must have email_verified = true unless this is set, for
+	// providers that only issue addresses they control but omit the claim
+	TrustUnverifiedEmail bool `toml:"trust_unverified_email"`
+}
+
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != "" && c.ClientID != ""
+}
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateMaxAge = 10 * time.Minute
+)
+
+// oidcClient holds the discovered provider. Discovery happens on first use
+// so that an unreachable identity provider doesn't stop the server starting.
+type oidcClient struct {
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// oidcClaims are the ID token claims we use. Groups are read separately
+// because the claim name is configurable.
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+}
+
+func (c *oidcClient) getProvider(ctx context.Context) (*oidc.Provider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.provider == nil {
+		provider, err := oidc.NewProvider(ctx, config.OIDC.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("OIDC discovery failed for %s: %w", config.OIDC.Issuer, err)
+		}
+		c.provider = provider
+	}
+	return c.provider, nil
+}
+
+func (am *AuthManager) oidcOAuth2Config(ctx context.Context, redirectURL string) (*oauth2.Config, *oidc.Provider, error) {
+	provider, err := am.oidc.getProvider(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &oauth2.Config{
+		ClientID:     config.OIDC.ClientID,
+		ClientSecret: config.OIDC.ClientSecret,
+		RedirectURL:  redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}, provider, nil
+}
+
+// OIDCAuthURL returns the identity provider URL to send the browser to.
+// state, nonce and verifier must be remembered until the callback.
+func (am *AuthManager) OIDCAuthURL(ctx context.Context, redirectURL, state, nonce, verifier string) (string, error) {
+	oauthConfig, _, err := am.oidcOAuth2Config(ctx, redirectURL)
+	if err != nil {
+		return "", err
+	}
+	return oauthConfig.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// OIDCLogin completes the authorization-code flow and returns the matching
+// local user, provisioning one if configured to.
+func (am *AuthManager) OIDCLogin(ctx context.Context, redirectURL, code, nonce, verifier string) (*User, error) {
+	oauthConfig, provider, err := am.oidcOAuth2Config(ctx, redirectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token in token response")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: config.OIDC.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify ID token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("ID token nonce mismatch")
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse ID token claims: %w", err)
+	}
+	if claims.Email == "" {
+		return nil, fmt.Errorf("ID token has no email claim")
+	}
+	verified := claims.EmailVerified != nil && *claims.EmailVerified
+	if !verified && !config.OIDC.TrustUnverifiedEmail {
+		return nil, fmt.Errorf("email %s is not verified by the identity provider", claims.Email)
+	}
+
+	var allClaims map[string]any
+	if err := idToken.Claims(&allClaims); err != nil {
+		return nil, fmt.Errorf("failed to parse ID token claims: %w", err)
+	}
+	isAdmin, groupsDecide := oidcAdminFromGroups(allClaims)
+
+	user, err := am.GetUserByEmail(claims.Email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if !config.OIDC.AutoProvision {
+			return nil, fmt.Errorf("no account for %s", claims.Email)
+		}
+		user, err = am.CreateUser(claims.Email, isAdmin)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Provisioned user %s from OIDC login", user.Email)
+	}
+
+	// Signing in through the identity provider proves ownership of the
+	// email address, so there is no need for the setup email flow
+	if !user.IsSetup {
+		if err := am.MarkUserSetup(user.ID); err != nil {
+			return nil, err
+		}
+		user.IsSetup = true
+	}
+
+	if groupsDecide && user.IsAdmin != isAdmin {
+		err := am.SetUserAdmin(user.ID, isAdmin)
+		if err == ErrLastAdmin {
+			log.Printf("Not removing admin from %s: they are the last admin", user.Email)
+		} else if err != nil {
+			return nil, err
+		} else {
+			user.IsAdmin = isAdmin
+		}
+	}
+
+	return user, nil
+}
+
+// oidcAdminFromGroups reports whether the token's groups include an admin
+// group, and whether group mapping is configured at all.
+func oidcAdminFromGroups(claims map[string]any) (isAdmin bool, configured bool) {
+	if len(config.OIDC.AdminGroups) == 0 {
+		return false, false
+	}
+	claimName := config.OIDC.GroupsClaim
+	if claimName == "" {
+		claimName = "groups"
+	}
+
+	var groups []string
+	switch v := claims[claimName].(type) {
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	case string:
+		groups = strings.Fields(v)
+	}
+
+	for _, g := range groups {
+		for _, admin := range config.OIDC.AdminGroups {
+			if g == admin {
+				return true, true
+			}
+		}
+	}
+	return false, true
+}
+
+// Redirect the browser to the identity provider
+func handleOIDCStart(w http.ResponseWriter, r *http.Request) {
+	state, err := generateSecureToken()
+	if err != nil {
+		panicf("Error generating OIDC state: %v", err)
+	}
+	nonce, err := generateSecureToken()
+	if err != nil {
+		panicf("Error generating OIDC nonce: %v", err)
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := authManager.OIDCAuthURL(r.Context(), oidcRedirectURL(r), state, nonce, verifier)
+	if err != nil {
+		log.Printf("OIDC login unavailable: %v", err)
+		renderLoginPage(w, LoginPage{Error: "Single sign-on is currently unavailable"})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    strings.Join([]string{state, nonce, verifier}, "."),
+		Path:     "/auth/oidc",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcStateMaxAge.Seconds()),
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Handle the identity provider's redirect back to us
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		renderLoginPage(w, LoginPage{Error: "Your sign-in attempt expired. Please sign in again."})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/auth/oidc", HttpOnly: true, Secure: isHTTPS(r), MaxAge: -1})
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || r.URL.Query().Get("state") != parts[0] {
+		renderLoginPage(w, LoginPage{Error: "Your sign-in attempt expired. Please sign in again."})
+		return
+	}
+	nonce, verifier := parts[1], parts[2]
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		log.Printf("OIDC provider returned error %s: %s", errCode, r.URL.Query().Get("error_description"))
+		renderLoginPage(w, LoginPage{Error: "Single sign-on failed"})
+		return
+	}
+
+	user, err := authManager.OIDCLogin(r.Context(), oidcRedirectURL(r), r.URL.Query().Get("code"), nonce, verifier)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		renderLoginPage(w, LoginPage{Error: "Single sign-on failed. Your account may not be registered for this course."})
+		return
+	}
+
+	completeLogin(w, r, user, "single sign-on")
+}
+
+func oidcRedirectURL(r *http.Request) string {
+	if config.OIDC.RedirectURL != "" {
+		return config.OIDC.RedirectURL
+	}
+	return baseURL(r) + "/auth/oidc/callback"
+}
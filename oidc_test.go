@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	mockClientID    = "comp3007"
+	mockRedirectURL = "http://app.test/auth/oidc/callback"
+)
+
+// mockIdP is just enough of an OpenID Connect provider for the
+// authorization-code flow with PKCE: discovery, keys, an authorize endpoint
+// that approves at once, and a token endpoint issuing signed ID tokens.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	requests map[string]url.Values // authorize requests by the code issued
+	claims   map[string]any        // added to every ID token
+	nonce    string                // if set, replaces the nonce sent by the client
+	tokens   int                   // codes exchanged
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, requests: make(map[string]url.Values), claims: make(map[string]any)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/keys",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := "code-" + q.Get("state")
+		idp.mu.Lock()
+		idp.requests[code] = q
+		idp.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", idp.handleToken)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.tokens++
+
+	req, ok := idp.requests[r.FormValue("code")]
+	delete(idp.requests, r.FormValue("code"))
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || req.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   idp.URL,
+		"sub":   "user-1",
+		"aud":   mockClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": req.Get("nonce"),
+	}
+	if idp.nonce != "" {
+		claims["nonce"] = idp.nonce
+	}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// setupOIDCTest points the config and auth manager at a new SQLite database
+// and the mock provider
+func setupOIDCTest(t *testing.T, idp *mockIdP, oidcConfig OIDCConfig) {
+	oidcConfig.Issuer = idp.URL
+	oidcConfig.ClientID = mockClientID
+	oidcConfig.ClientSecret = "secret"
+	oidcConfig.RedirectURL = mockRedirectURL
+	setupTest(t, ServerConfig{OIDC: oidcConfig})
+}
+
+// oidcSignIn goes through /auth/oidc/start, the provider, and
+// /auth/oidc/callback. tamper may change the callback URL.
+func oidcSignIn(t *testing.T, idp *mockIdP, tamper func(*url.URL)) *httptest.ResponseRecorder {
+	start := httptest.NewRecorder()
+	handleOIDCStart(start, httptest.NewRequest("GET", "http://app.test/auth/oidc/start", nil))
+	if start.Code != http.StatusFound {
+		t.Fatalf("start: got status %d, want 302", start.Code)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callbackURL, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(callbackURL)
+	}
+
+	req := httptest.NewRequest("GET", callbackURL.String(), nil)
+	for _, cookie := range start.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	callback := httptest.NewRecorder()
+	handleOIDCCallback(callback, req)
+	return callback
+}
+
+func signedIn(rec *httptest.ResponseRecorder) bool {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "auth_token" && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	setupOIDCTest(t, idp, OIDCConfig{AutoProvision: true})
+	idp.claims["email"] = "new@example.edu"
+	idp.claims["email_verified"] = true
+
+	rec := oidcSignIn(t, idp, nil)
+	if rec.Code != http.StatusSeeOther || !signedIn(rec) {
+		t.Fatalf("got status %d and no session, want a redirect with a session cookie: %s", rec.Code, rec.Body)
+	}
+	user, err := authManager.GetUserByEmail("new@example.edu")
+	if err != nil || user == nil || !user.IsSetup {
+		t.Fatalf("provisioned user = %+v, %v; want a set-up account", user, err)
+	}
+}
+
+func TestOIDCLoginChecksState(t *testing.T) {
+	idp := newMockIdP(t)
+	setupOIDCTest(t, idp, OIDCConfig{AutoProvision: true})
+	idp.claims["email"] = "new@example.edu"
+	idp.claims["email_verified"] = true
+
+	rec := oidcSignIn(t, idp, func(u *url.URL) {
+		q := u.Query()
+		q.Set("state", "forged")
+		u.RawQuery = q.Encode()
+	})
+	if signedIn(rec) || !strings.Contains(rec.Body.String(), "sign-in attempt expired") {
+		t.Fatalf("a forged state was accepted: status %d", rec.Code)
+	}
+	if idp.tokens != 0 {
+		t.Errorf("the code was exchanged %d times despite the bad state", idp.tokens)
+	}
+}
+
+func TestOIDCLoginChecksNonce(t *testing.T) {
+	idp := newMockIdP(t)
+	setupOIDCTest(t, idp, OIDCConfig{AutoProvision: true})
+	idp.claims["email"] = "new@example.edu"
+	idp.claims["email_verified"] = true
+	idp.nonce = "replayed"
+
+	rec := oidcSignIn(t, idp, nil)
+	if signedIn(rec) || !strings.Contains(rec.Body.String(), "Single sign-on failed") {
+		t.Fatalf("an ID token with the wrong nonce was accepted: status %d", rec.Code)
+	}
+	if user, _ := authManager.GetUserByEmail("new@example.edu"); user != nil {
+		t.Errorf("a user was provisioned from an ID token with the wrong nonce")
+	}
+}
+
+func TestOIDCLoginEmailVerified(t *testing.T) {
+	tests := []struct {
+		name     string
+		verified any // nil leaves the claim out
+		trust    bool
+		want     bool
+	}{
+		{"verified", true, false, true},
+		{"unverified", false, false, false},
+		{"missing", nil, false, false},
+		{"missing, trusted", nil, true, true},
+		{"unverified, trusted", false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			setupOIDCTest(t, idp, OIDCConfig{AutoProvision: true, TrustUnverifiedEmail: tt.trust})
+			idp.claims["email"] = "new@example.edu"
+			if tt.verified != nil {
+				idp.claims["email_verified"] = tt.verified
+			}
+
+			if got := signedIn(oidcSignIn(t, idp, nil)); got != tt.want {
+				t.Errorf("signed in = %v, want %v", got, tt.want)
+			}
+			user, _ := authManager.GetUserByEmail("new@example.edu")
+			if (user != nil) != tt.want {
+				t.Errorf("user provisioned = %v, want %v", user != nil, tt.want)
+			}
+		})
+	}
+}
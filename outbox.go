@@ -0,0 +1,350 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Outgoing email is queued in the email_outbox table and delivered by a
+// background worker, so a mail provider that is down or over quota delays
+// email instead of failing the request that sent it. Failed sends are
+// retried with exponential backoff; after max_attempts the message is
+// marked failed and stays that way until someone retries it from
+// /admin/email-outbox. Messages holding a setup or sign-in link are the
+// exception: their bodies are cleared when they fail for good or the link
+// expires, and they are resent by issuing a new link instead.
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+)
+
+const (
+	outboxPoll       = 30 * time.Second // how often the worker checks when nothing wakes it
+	outboxLease      = 10 * time.Minute // a claimed message is tried again after this if its send never finishes
+	outboxFirstRetry = time.Minute      // doubled after each further failure
+	outboxMaxRetry   = 6 * time.Hour
+	outboxBatch      = 50
+	outboxPageLimit  = 500
+
+	defaultMailRatePerMinute = 60
+	defaultMailMaxAttempts   = 8
+)
+
+// OutboxMessage is a queued email, without its body
+type OutboxMessage struct {
+	ID            int
+	To            string
+	Subject       string
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	SentAt        *time.Time
+	HasLink       bool // can't be retried once failed, as the body is gone
+}
+
+type OutboxPage struct {
+	Error     string
+	Success   string
+	Pending   []*OutboxMessage
+	Failed    []*OutboxMessage
+	SentToday int
+	User      *AuthClaims
+	Nav       []NavItem
+}
+
+// QueueEmail adds msg to the outbox and wakes the worker. linkExpiry is when
+// the link in msg stops working, or zero if it has none. The only errors are
+// from the database; delivery failures are handled by the worker.
+func (am *AuthManager) QueueEmail(msg *EmailMessage, linkExpiry time.Time) error {
+	now := time.Now()
+	var expiry sql.NullTime
+	if !linkExpiry.IsZero() {
+		expiry = sql.NullTime{Time: linkExpiry, Valid: true}
+	}
+	_, err := am.db.Exec(`
+		INSERT INTO email_outbox (recipient, subject, html, text, status, next_attempt_at, created_at, link_expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, msg.To, msg.Subject, msg.HTML, msg.Text, outboxPending, now, now, expiry)
+	if err != nil {
+		return fmt.Errorf("failed to queue email to %s: %w", msg.To, err)
+	}
+	am.wakeOutbox()
+	return nil
+}
+
+func (am *AuthManager) wakeOutbox() {
+	select {
+	case am.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// startOutbox starts the worker that delivers queued email. Only the server
+// runs it; email queued by command-line commands is sent by the server.
+func (am *AuthManager) startOutbox() {
+	perMinute := config.Mail.RatePerMinute
+	if perMinute <= 0 {
+		perMinute = defaultMailRatePerMinute
+	}
+	maxAttempts := config.Mail.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMailMaxAttempts
+	}
+
+	go func() {
+		// Sends wait for a tick, so at most one is sent per interval. Ticks
+		// aren't saved up while the outbox is idle.
+		throttle := time.NewTicker(time.Minute / time.Duration(perMinute))
+		defer throttle.Stop()
+		for {
+			n, err := am.deliverOutbox(throttle.C, maxAttempts)
+			if err != nil {
+				log.Printf("Error delivering queued email: %v", err)
+			}
+			if n == outboxBatch {
+				continue
+			}
+			select {
+			case <-am.outboxWake:
+			case <-time.After(outboxPoll):
+			}
+		}
+	}()
+}
+
+// deliverOutbox tries to send up to outboxBatch due messages, returning how
+// many it tried
+func (am *AuthManager) deliverOutbox(throttle <-chan time.Time, maxAttempts int) (int, error) {
+	if err := am.expireOutboxLinks(); err != nil {
+		return 0, err
+	}
+
+	rows, err := am.db.Query(`
+		SELECT id, attempts FROM email_outbox
+		WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY id LIMIT ?
+	`, outboxPending, time.Now(), outboxBatch)
+	if err != nil {
+		return 0, err
+	}
+	type due struct{ id, attempts int }
+	var batch []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range batch {
+		<-throttle
+		if err := am.deliverQueuedEmail(d.id, d.attempts, maxAttempts); err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), nil
+}
+
+// deliverQueuedEmail claims one message and sends it. Claiming bumps its
+// attempts, so if another server sharing the database got there first,
+// nothing happens here.
+func (am *AuthManager) deliverQueuedEmail(id, attempts, maxAttempts int) error {
+	result, err := am.db.Exec(`
+		UPDATE email_outbox SET attempts = attempts + 1, next_attempt_at = ?
+		WHERE id = ? AND status = ? AND attempts = ?
+	`, time.Now().Add(outboxLease), id, outboxPending, attempts)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return nil
+	}
+	attempts++
+
+	msg := &EmailMessage{}
+	err = am.db.QueryRow(`SELECT recipient, subject, html, text FROM email_outbox WHERE id = ?`, id).
+		Scan(&msg.To, &msg.Subject, &msg.HTML, &msg.Text)
+	if err != nil {
+		return err
+	}
+
+	if sendErr := am.mailer.Send(msg); sendErr == nil {
+		_, err = am.db.Exec(`
+			UPDATE email_outbox SET status = ?, sent_at = ?, html = '', text = '', last_error = ''
+			WHERE id = ?
+		`, outboxSent, time.Now(), id)
+	} else if attempts >= maxAttempts {
+		log.Printf("Giving up on email to %s after %d attempts: %v", msg.To, attempts, sendErr)
+		_, err = am.db.Exec(`
+			UPDATE email_outbox SET status = ?, last_error = ?,
+				html = CASE WHEN link_expires_at IS NULL THEN html ELSE '' END,
+				text = CASE WHEN link_expires_at IS NULL THEN text ELSE '' END
+			WHERE id = ?
+		`, outboxFailed, sendErr.Error(), id)
+	} else {
+		retry := outboxRetryDelay(attempts)
+		log.Printf("Error sending email to %s, retrying in %v: %v", msg.To, retry, sendErr)
+		_, err = am.db.Exec(`UPDATE email_outbox SET next_attempt_at = ?, last_error = ? WHERE id = ?`,
+			time.Now().Add(retry), sendErr.Error(), id)
+	}
+	return err
+}
+
+// expireOutboxLinks fails pending messages whose link has stopped working,
+// clearing their bodies
+func (am *AuthManager) expireOutboxLinks() error {
+	result, err := am.db.Exec(`
+		UPDATE email_outbox SET status = ?, html = '', text = '', last_error = ?
+		WHERE status = ? AND link_expires_at <= ?
+	`, outboxFailed, "The link expired before the email could be sent", outboxPending, time.Now())
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Dropped %d queued email(s) whose links expired", n)
+	}
+	return nil
+}
+
+// outboxRetryDelay is how long to wait after the given number of failed
+// attempts: 1 minute, then 2, 4, 8 and so on up to outboxMaxRetry
+func outboxRetryDelay(attempts int) time.Duration {
+	delay := outboxFirstRetry
+	for i := 1; i < attempts && delay < outboxMaxRetry; i++ {
+		delay *= 2
+	}
+	return min(delay, outboxMaxRetry)
+}
+
+// GetOutbox returns messages with the given status, oldest first
+func (am *AuthManager) GetOutbox(status string, limit int) ([]*OutboxMessage, error) {
+	rows, err := am.db.Query(`
+		SELECT id, recipient, subject, status, attempts, next_attempt_at, last_error, created_at, sent_at,
+			link_expires_at IS NOT NULL
+		FROM email_outbox WHERE status = ? ORDER BY id LIMIT ?
+	`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*OutboxMessage
+	for rows.Next() {
+		msg := &OutboxMessage{}
+		var sentAt sql.NullTime
+		err := rows.Scan(&msg.ID, &msg.To, &msg.Subject, &msg.Status, &msg.Attempts,
+			&msg.NextAttemptAt, &msg.LastError, &msg.CreatedAt, &sentAt, &msg.HasLink)
+		if err != nil {
+			return nil, err
+		}
+		if sentAt.Valid {
+			msg.SentAt = &sentAt.Time
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// CountSentEmail counts messages sent since the given time
+func (am *AuthManager) CountSentEmail(since time.Time) (int, error) {
+	var count int
+	err := am.db.QueryRow(`SELECT COUNT(*) FROM email_outbox WHERE status = ? AND sent_at >= ?`,
+		outboxSent, since).Scan(&count)
+	return count, err
+}
+
+// RetryEmail puts failed messages back in the queue with a fresh set of
+// attempts: the one with the given ID, or all of them if id is 0. Messages
+// with links are skipped, since their bodies were cleared. It returns how
+// many were requeued.
+func (am *AuthManager) RetryEmail(id int) (int, error) {
+	query := `UPDATE email_outbox SET status = ?, attempts = 0, next_attempt_at = ?
+		WHERE status = ? AND link_expires_at IS NULL`
+	args := []any{outboxPending, time.Now(), outboxFailed}
+	if id != 0 {
+		query += ` AND id = ?`
+		args = append(args, id)
+	}
+	result, err := am.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	if n > 0 {
+		am.wakeOutbox()
+	}
+	return int(n), nil
+}
+
+// Pending and failed email, with retry buttons for the failures
+func handleEmailOutbox(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	if !userClaims.Can(PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	page := OutboxPage{User: userClaims, Nav: config.navItems}
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "retry", "retry-all":
+			id := 0
+			if r.FormValue("action") == "retry" {
+				var err error
+				if id, err = strconv.Atoi(r.FormValue("id")); err != nil || id <= 0 {
+					http.Error(w, "Invalid message ID", http.StatusBadRequest)
+					return
+				}
+			}
+			n, err := authManager.RetryEmail(id)
+			if err != nil {
+				page.Error = Capitalize(err.Error())
+				break
+			}
+			if n == 0 {
+				page.Error = "No failed messages to retry"
+				break
+			}
+			authManager.Audit(r, AuditEmailRetry, "", fmt.Sprintf("requeued %d failed email(s)", n))
+			page.Success = fmt.Sprintf("Requeued %d failed email(s)", n)
+
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	if page.Pending, err = authManager.GetOutbox(outboxPending, outboxPageLimit); err == nil {
+		if page.Failed, err = authManager.GetOutbox(outboxFailed, outboxPageLimit); err == nil {
+			page.SentToday, err = authManager.CountSentEmail(time.Now().Add(-24 * time.Hour))
+		}
+	}
+	if err != nil {
+		panicf("Error getting email outbox: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := config.templates.ExecuteTemplate(w, "admin-email-outbox.html", page); err != nil {
+		panicf("Error executing email outbox template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultMinPasswordLength = 8
+
+// PasswordPolicy is the [password_policy] table of the server config. It
+// applies to passwords users choose at setup and on the profile page.
+type PasswordPolicy struct {
+	MinLength      int    `toml:"min_length"`      // defaults to 8
+	BannedList     string `toml:"banned_list"`     // file of forbidden passwords, one per line
+	BreachedHashes string `toml:"breached_hashes"` // directory of breached password hash ranges, see checkBreached
+	AllowEmail     bool   `toml:"allow_email"`     // allow passwords containing the user's email name
+}
+
+// PasswordError explains why a password was rejected, in words fit to show
+// the user
+type PasswordError struct {
+	Reason string
+}
+
+func (e *PasswordError) Error() string {
+	return e.Reason
+}
+
+// loadPasswordPolicy applies defaults and reads the banned list into memory
+func (am *AuthManager) loadPasswordPolicy(policy PasswordPolicy) error {
+	if policy.MinLength <= 0 {
+		policy.MinLength = defaultMinPasswordLength
+	}
+	am.passwordPolicy = policy
+	am.bannedPasswords = make(map[string]bool)
+
+	if policy.BannedList != "" {
+		file, err := os.Open(policy.BannedList)
+		if err != nil {
+			return fmt.Errorf("failed to open banned password list: %w", err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if word := strings.TrimSpace(scanner.Text()); word != "" && !strings.HasPrefix(word, "#") {
+				am.bannedPasswords[strings.ToLower(word)] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read banned password list: %w", err)
+		}
+	}
+
+	if policy.BreachedHashes != "" {
+		if info, err := os.Stat(policy.BreachedHashes); err != nil || !info.IsDir() {
+			return fmt.Errorf("breached_hashes must be a directory: %s", policy.BreachedHashes)
+		}
+	}
+	return nil
+}
+
+// PasswordPolicy returns the policy in force, with defaults filled in
+func (am *AuthManager) PasswordPolicy() PasswordPolicy {
+	return am.passwordPolicy
+}
+
+// CheckPassword applies the password policy to a new password for the user
+// with the given email. It returns a *PasswordError if the password is
+// rejected.
+func (am *AuthManager) CheckPassword(password, email string) error {
+	policy := am.passwordPolicy
+	if len([]rune(password)) < policy.MinLength {
+		return &PasswordError{fmt.Sprintf("Password must be at least %d characters long", policy.MinLength)}
+	}
+
+	lower := strings.ToLower(password)
+	if !policy.AllowEmail {
+		name, _, _ := strings.Cut(strings.ToLower(email), "@")
+		if len(name) >= 3 && strings.Contains(lower, name) {
+			return &PasswordError{"Password must not contain your email address"}
+		}
+	}
+
+	if am.bannedPasswords[lower] {
+		return &PasswordError{"That password is too common. Please choose another."}
+	}
+
+	if policy.BreachedHashes != "" {
+		breached, err := checkBreached(policy.BreachedHashes, password)
+		if err != nil {
+			// An unreadable list shouldn't stop anyone setting a password
+			log.Printf("Error checking breached passwords: %v", err)
+		} else if breached {
+			return &PasswordError{"That password has appeared in a data breach. Please choose another."}
+		}
+	}
+	return nil
+}
+
+// checkBreached looks a password up in an offline copy of a k-anonymity
+// breach list, such as the one from Have I Been Pwned's downloader. The
+// directory holds one file per 5-character prefix of the uppercase SHA-1
+// hash, e.g. "5BAA6.txt", with lines of the form "SUFFIX:COUNT".
+func checkBreached(dir, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), ":")
+		if strings.EqualFold(strings.TrimSpace(line), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
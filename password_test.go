@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	dir := t.TempDir()
+	banned := filepath.Join(dir, "banned.txt")
+	if err := os.WriteFile(banned, []byte("# common passwords\nletmein12345\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// One breached password, in the Have I Been Pwned range format
+	breached := filepath.Join(dir, "breached")
+	if err := os.Mkdir(breached, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("correct horse battery"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(filepath.Join(breached, hash[:5]+".txt"), []byte("0000000000000000000000000000000000A:1\r\n"+hash[5:]+":42\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	setupTest(t, ServerConfig{PasswordPolicy: PasswordPolicy{MinLength: 12, BannedList: banned, BreachedHashes: breached}})
+
+	tests := []struct {
+		password string
+		wantErr  string // empty if the password is allowed
+	}{
+		{testPassword, ""},
+		{"short-pw", "at least 12 characters"},
+		{"LetMeIn12345", "too common"},
+		{"correct horse battery", "data breach"},
+		{"Correct horse battery", ""}, // a different hash
+		{"student-is-my-name", "email address"},
+	}
+	for _, tt := range tests {
+		err := authManager.CheckPassword(tt.password, "student@example.edu")
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("CheckPassword(%q) = %v, want nil", tt.password, err)
+			}
+			continue
+		}
+		var passwordErr *PasswordError
+		if !errors.As(err, &passwordErr) || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("CheckPassword(%q) = %v, want a PasswordError about %q", tt.password, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHashConfig is the [password_hash] table of the server config. It
+// decides how new passwords are stored. Hashes made with other settings
+// keep working and are upgraded the next time their owner signs in.
+type PasswordHashConfig struct {
+	Algorithm     string `toml:"algorithm"`      // "bcrypt" (default) or "argon2id"
+	BcryptCost    int    `toml:"bcrypt_cost"`    // defaults to bcrypt.DefaultCost
+	Argon2Memory  uint32 `toml:"argon2_memory"`  // in KiB, defaults to 19456 (19 MiB)
+	Argon2Time    uint32 `toml:"argon2_time"`    // passes over memory, defaults to 2
+	Argon2Threads uint8  `toml:"argon2_threads"` // defaults to 1
+}
+
+const (
+	hashBcrypt   = "bcrypt"
+	hashArgon2id = "argon2id"
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var errUnknownHash = errors.New("unknown password hash format")
+
+// withDefaults fills in unset fields and checks the algorithm name
+func (c PasswordHashConfig) withDefaults() (PasswordHashConfig, error) {
+	if c.Algorithm == "" {
+		c.Algorithm = hashBcrypt
+	}
+	if c.Algorithm != hashBcrypt && c.Algorithm != hashArgon2id {
+		return c, fmt.Errorf("unknown password hash algorithm %q", c.Algorithm)
+	}
+	if c.BcryptCost == 0 {
+		c.BcryptCost = bcrypt.DefaultCost
+	}
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		return c, fmt.Errorf("bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if c.Argon2Memory == 0 {
+		c.Argon2Memory = 19 * 1024
+	}
+	if c.Argon2Time == 0 {
+		c.Argon2Time = 2
+	}
+	if c.Argon2Threads == 0 {
+		c.Argon2Threads = 1
+	}
+	return c, nil
+}
+
+// HashPassword hashes a password with the configured algorithm
+func (am *AuthManager) HashPassword(password string) (string, error) {
+	c := am.passwordHash
+	if c.Algorithm == hashArgon2id {
+		salt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, c.Argon2Time, c.Argon2Memory, c.Argon2Threads, argon2KeyLength)
+		return encodeArgon2id(argon2Params{c.Argon2Memory, c.Argon2Time, c.Argon2Threads}, salt, key), nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), c.BcryptCost)
+	return string(hash), err
+}
+
+// checkPasswordHash reports whether password matches a stored hash of
+// either kind
+func checkPasswordHash(hash, password string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// needsRehash reports whether a stored hash was made with a different
+// algorithm or settings than the configured ones
+func (am *AuthManager) needsRehash(hash string) bool {
+	c := am.passwordHash
+	if strings.HasPrefix(hash, "$argon2id$") {
+		if c.Algorithm != hashArgon2id {
+			return true
+		}
+		params, salt, key, err := decodeArgon2id(hash)
+		return err != nil || len(salt) != argon2SaltLength || len(key) != argon2KeyLength ||
+			params != argon2Params{c.Argon2Memory, c.Argon2Time, c.Argon2Threads}
+	}
+	if c.Algorithm != hashBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != c.BcryptCost
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// Argon2id hashes are stored in the PHC string format used by the reference
+// implementation: $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+func encodeArgon2id(params argon2Params, salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func decodeArgon2id(hash string) (params argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != hashArgon2id {
+		return params, nil, nil, errUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, errUnknownHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, errUnknownHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, errUnknownHash
+	}
+	return params, salt, key, nil
+}
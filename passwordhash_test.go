@@ -0,0 +1,61 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginUpgradesPasswordHash(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     PasswordHashConfig
+		wantPrefix string
+	}{
+		{"bcrypt to argon2id", PasswordHashConfig{Algorithm: hashArgon2id, Argon2Memory: 1024, Argon2Time: 1}, "$argon2id$"},
+		{"bcrypt cost", PasswordHashConfig{BcryptCost: bcrypt.MinCost + 1}, "$2a$05$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t, ServerConfig{PasswordHash: tt.config})
+			user := newTestUser(t, "student@example.edu", false)
+			old, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := authManager.users.SetPassword(user.ID, string(old)); err != nil {
+				t.Fatal(err)
+			}
+			storedHash := func() string {
+				user, err := authManager.GetUserByID(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return user.Password
+			}
+
+			if _, err := authManager.ValidateCredentials(user.Email, "wrong-password"); err != ErrInvalidCredentials {
+				t.Errorf("a wrong password: got %v, want ErrInvalidCredentials", err)
+			}
+			if storedHash() != string(old) {
+				t.Error("a failed sign-in changed the stored hash")
+			}
+
+			if _, err := authManager.ValidateCredentials(user.Email, testPassword); err != nil {
+				t.Fatalf("signing in with the old hash: %v", err)
+			}
+			upgraded := storedHash()
+			if !strings.HasPrefix(upgraded, tt.wantPrefix) {
+				t.Errorf("after sign-in the hash is %q, want prefix %q", upgraded, tt.wantPrefix)
+			}
+
+			if _, err := authManager.ValidateCredentials(user.Email, testPassword); err != nil {
+				t.Fatalf("signing in with the upgraded hash: %v", err)
+			}
+			if storedHash() != upgraded {
+				t.Error("a current hash was replaced again")
+			}
+		})
+	}
+}
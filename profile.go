@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const maxProfileFieldLength = 100
+
+// Profile holds the fields users may edit about themselves
+type Profile struct {
+	Name          string
+	PreferredName string
+	StudentNumber string
+	Pronouns      string
+}
+
+// DisplayName is the name to greet the user by: their preferred name, else
+// their name, else their email address.
+func (c *AuthClaims) DisplayName() string {
+	if c.PreferredName != "" {
+		return c.PreferredName
+	}
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Email
+}
+
+func (am *AuthManager) UpdateUserProfile(userID int, profile Profile) error {
+	for _, field := range [][2]string{
+		{"name", profile.Name},
+		{"preferred name", profile.PreferredName},
+		{"student number", profile.StudentNumber},
+		{"pronouns", profile.Pronouns},
+	} {
+		if utf8.RuneCountInString(field[1]) > maxProfileFieldLength {
+			return fmt.Errorf("%s must be at most %d characters", field[0], maxProfileFieldLength)
+		}
+	}
+
+	return am.users.SetProfile(userID, profile)
+}
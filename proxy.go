@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseTrustedProxies reads the trusted_proxies setting. Each entry is an IP
+// address or a CIDR range.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// parsePublicURL checks the public_url setting and strips any trailing slash
+func parsePublicURL(publicURL string) (string, error) {
+	if publicURL == "" {
+		return "", nil
+	}
+	u, err := url.Parse(publicURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("public_url must be an absolute http or https URL, got %q", publicURL)
+	}
+	return strings.TrimSuffix(publicURL, "/"), nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range config.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// fromTrustedProxy reports whether the request was made by one of our
+// proxies, whose X-Forwarded-* headers we can believe
+func fromTrustedProxy(r *http.Request) bool {
+	return isTrustedProxy(net.ParseIP(remoteIP(r)))
+}
+
+// clientIP returns the address the request came from. Behind a trusted
+// proxy this is the last address in X-Forwarded-For that isn't one of our
+// proxies; anything before it could have been made up by the client.
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !fromTrustedProxy(r) {
+		return ip
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// isHTTPS reports whether the browser reached us over HTTPS, either
+// directly, through a trusted proxy that says so, or because public_url
+// says that's the only way in
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if fromTrustedProxy(r) {
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if strings.EqualFold(strings.TrimSpace(proto), "https") {
+			return true
+		}
+	}
+	return strings.HasPrefix(config.PublicURL, "https://")
+}
+
+// baseURL is the scheme and host that links sent to users should point at,
+// with no trailing slash
+func baseURL(r *http.Request) string {
+	if config.PublicURL != "" {
+		return config.PublicURL
+	}
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// startupBaseURL is baseURL for links made outside any request, such as
+// those logged at startup or printed by commands
+func startupBaseURL() string {
+	if config.PublicURL != "" {
+		return config.PublicURL
+	}
+	return "http://localhost:" + config.Port
+}
+
+// publicHost is the host browsers use to reach us, for origin checks
+func publicHost(r *http.Request) string {
+	if config.PublicURL != "" {
+		if u, err := url.Parse(config.PublicURL); err == nil {
+			return u.Host
+		}
+	}
+	return r.Host
+}
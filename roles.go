@@ -0,0 +1,368 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Permissions checked by RequirePermission and the templates. Admins
+// (users.is_admin) implicitly hold every permission.
+const (
+	PermUsersView        = "users.view"        // see the user list
+	PermUsersManage      = "users.manage"      // add users and resend setup emails
+	PermRolesManage      = "roles.manage"      // edit roles and assign them to users
+	PermContentPreview   = "content.preview"   // view unpublished "_" files and directories
+	PermSubmissionsGrade = "submissions.grade" // grade student submissions
+	PermAuditView        = "audit.view"        // read and export the audit log
+)
+
+var allPermissions = []string{
+	PermUsersView,
+	PermUsersManage,
+	PermRolesManage,
+	PermContentPreview,
+	PermSubmissionsGrade,
+	PermAuditView,
+}
+
+// Roles created in a new database. Admins can edit or delete them.
+var defaultRoles = []*Role{
+	{Name: "instructor", Description: "Runs the course", Permissions: allPermissions},
+	{Name: "ta", Description: "Teaching assistant", Permissions: []string{PermUsersView, PermContentPreview, PermSubmissionsGrade}},
+	{Name: "student", Description: "Enrolled student"},
+	{Name: "auditor", Description: "Auditing the course"},
+}
+
+type Role struct {
+	ID          int
+	Name        string
+	Description string
+	Permissions []string
+}
+
+type RolesPage struct {
+	Error       string
+	Success     string
+	Roles       []*Role
+	Permissions []string
+	User        *AuthClaims
+	Nav         []NavItem
+}
+
+func (r *Role) Has(permission string) bool {
+	return containsString(r.Permissions, permission)
+}
+
+// Can reports whether the current user holds permission. API tokens only
+// carry role permissions if they have the admin scope.
+func (c *AuthClaims) Can(permission string) bool {
+	if c == nil {
+		return false
+	}
+	if c.Scopes != nil && !containsString(c.Scopes, ScopeAdmin) {
+		return false
+	}
+	return c.IsAdmin || containsString(c.Permissions, permission)
+}
+
+func (am *AuthManager) createDefaultRoles() error {
+	var count int
+	if err := am.db.QueryRow("SELECT COUNT(*) FROM roles").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	for _, role := range defaultRoles {
+		if _, err := am.CreateRole(role.Name, role.Description, role.Permissions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (am *AuthManager) CreateRole(name, description string, permissions []string) (*Role, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return nil, fmt.Errorf("role name is required")
+	}
+	var id int
+	err := am.db.QueryRow(`INSERT INTO roles (name, description) VALUES (?, ?) RETURNING id`, name, description).Scan(&id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create role %s: %w", name, err)
+	}
+	if err := am.SetRolePermissions(id, permissions); err != nil {
+		return nil, err
+	}
+	return &Role{ID: id, Name: name, Description: description, Permissions: permissions}, nil
+}
+
+func (am *AuthManager) SetRolePermissions(roleID int, permissions []string) error {
+	for _, permission := range permissions {
+		if !containsString(allPermissions, permission) {
+			return fmt.Errorf("unknown permission %q", permission)
+		}
+	}
+	if _, err := am.db.Exec(`DELETE FROM role_permissions WHERE role_id = ?`, roleID); err != nil {
+		return fmt.Errorf("failed to clear role permissions: %w", err)
+	}
+	for _, permission := range permissions {
+		_, err := am.db.Exec(`INSERT INTO role_permissions (role_id, permission) VALUES (?, ?)`, roleID, permission)
+		if err != nil {
+			return fmt.Errorf("failed to add role permission: %w", err)
+		}
+	}
+	return nil
+}
+
+func (am *AuthManager) DeleteRole(roleID int) error {
+	if _, err := am.db.Exec(`DELETE FROM user_roles WHERE role_id = ?`, roleID); err != nil {
+		return fmt.Errorf("failed to unassign role: %w", err)
+	}
+	if _, err := am.db.Exec(`DELETE FROM role_permissions WHERE role_id = ?`, roleID); err != nil {
+		return fmt.Errorf("failed to clear role permissions: %w", err)
+	}
+	if _, err := am.db.Exec(`DELETE FROM roles WHERE id = ?`, roleID); err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+	return nil
+}
+
+func (am *AuthManager) GetAllRoles() ([]*Role, error) {
+	rows, err := am.db.Query(`
+		SELECT r.id, r.name, COALESCE(r.description, ''), COALESCE(p.permission, '')
+		FROM roles r LEFT JOIN role_permissions p ON p.role_id = r.id
+		ORDER BY r.id, p.permission
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*Role
+	var current *Role
+	for rows.Next() {
+		var id int
+		var name, description, permission string
+		if err := rows.Scan(&id, &name, &description, &permission); err != nil {
+			return nil, err
+		}
+		if current == nil || current.ID != id {
+			current = &Role{ID: id, Name: name, Description: description}
+			roles = append(roles, current)
+		}
+		if permission != "" {
+			current.Permissions = append(current.Permissions, permission)
+		}
+	}
+	return roles, rows.Err()
+}
+
+func (am *AuthManager) GetRoleByName(name string) (*Role, error) {
+	role := &Role{}
+	err := am.db.QueryRow(`SELECT id, name, COALESCE(description, '') FROM roles WHERE name = ?`,
+		strings.ToLower(name)).Scan(&role.ID, &role.Name, &role.Description)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// SetUserRoles replaces the user's roles with the named ones
+func (am *AuthManager) SetUserRoles(userID int, roleNames []string) error {
+	var roleIDs []int
+	for _, name := range roleNames {
+		role, err := am.GetRoleByName(name)
+		if err != nil {
+			return err
+		}
+		if role == nil {
+			return fmt.Errorf("unknown role %q", name)
+		}
+		roleIDs = append(roleIDs, role.ID)
+	}
+
+	return am.inTx(func(tx *Tx, _ UserStore) error {
+		return setUserRoleIDs(tx, userID, roleIDs)
+	})
+}
+
+func setUserRoleIDs(q querier, userID int, roleIDs []int) error {
+	if _, err := q.Exec(`DELETE FROM user_roles WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to clear user roles: %w", err)
+	}
+	for _, roleID := range roleIDs {
+		if _, err := q.Exec(`INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)`, userID, roleID); err != nil {
+			return fmt.Errorf("failed to assign role: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetUserRoleNames returns role names for every user that has any
+func (am *AuthManager) GetUserRoleNames() (map[int][]string, error) {
+	rows, err := am.db.Query(`
+		SELECT ur.user_id, r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		ORDER BY r.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[int][]string)
+	for rows.Next() {
+		var userID int
+		var name string
+		if err := rows.Scan(&userID, &name); err != nil {
+			return nil, err
+		}
+		names[userID] = append(names[userID], name)
+	}
+	return names, rows.Err()
+}
+
+func (am *AuthManager) GetUserPermissions(userID int) ([]string, error) {
+	rows, err := am.db.Query(`
+		SELECT DISTINCT rp.permission
+		FROM user_roles ur JOIN role_permissions rp ON rp.role_id = ur.role_id
+		WHERE ur.user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+// RequirePermission allows the request through only if the user holds
+// permission, either through a role or by being an admin.
+func (am *AuthManager) RequirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return am.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if config.AuthDisabled {
+			next(w, r)
+			return
+		}
+		claims := GetUserFromContext(r.Context())
+		if !claims.Can(permission) {
+			http.Error(w, "Access denied: "+permission+" permission required", http.StatusForbidden)
+			return
+		}
+		if am.needsSecondFactor(claims) {
+			http.Redirect(w, r, "/profile?two_factor=required", http.StatusSeeOther)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Admin page for editing roles and their permissions
+func handleRoles(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	page := RolesPage{User: userClaims, Nav: config.navItems, Permissions: allPermissions}
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			role, err := authManager.CreateRole(r.FormValue("name"), strings.TrimSpace(r.FormValue("description")), r.Form["permissions"])
+			if err != nil {
+				page.Error = Capitalize(err.Error())
+				break
+			}
+			authManager.Audit(r, AuditRoleUpdate, role.Name, "created with "+strings.Join(role.Permissions, ", "))
+			page.Success = "Role created"
+
+		case "update":
+			roleID, err := strconv.Atoi(r.FormValue("role_id"))
+			if err != nil {
+				http.Error(w, "Invalid role ID", http.StatusBadRequest)
+				return
+			}
+			if err := authManager.SetRolePermissions(roleID, r.Form["permissions"]); err != nil {
+				page.Error = Capitalize(err.Error())
+				break
+			}
+			authManager.Audit(r, AuditRoleUpdate, fmt.Sprintf("role %d", roleID), "permissions: "+strings.Join(r.Form["permissions"], ", "))
+			page.Success = "Role updated"
+
+		case "delete":
+			roleID, err := strconv.Atoi(r.FormValue("role_id"))
+			if err != nil {
+				http.Error(w, "Invalid role ID", http.StatusBadRequest)
+				return
+			}
+			if err := authManager.DeleteRole(roleID); err != nil {
+				panicf("Error deleting role: %v", err)
+				page.Error = "Failed to delete role"
+				break
+			}
+			authManager.Audit(r, AuditRoleUpdate, fmt.Sprintf("role %d", roleID), "deleted")
+			page.Success = "Role deleted"
+
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roles, err := authManager.GetAllRoles()
+	if err != nil {
+		panicf("Error getting roles: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	page.Roles = roles
+
+	if err := config.templates.ExecuteTemplate(w, "admin-roles.html", page); err != nil {
+		panicf("Error executing roles template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Assign a role to a user from the manage users page
+func handleSetUserRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var roles []string
+	if role := r.FormValue("role"); role != "" {
+		roles = []string{role}
+	}
+	if err := authManager.SetUserRoles(userID, roles); err != nil {
+		http.Error(w, Capitalize(err.Error()), http.StatusBadRequest)
+		return
+	}
+	target := fmt.Sprintf("user %d", userID)
+	if user, err := authManager.GetUserByID(userID); err == nil && user != nil {
+		target = user.Email
+	}
+	authManager.Audit(r, AuditRoleUpdate, target, "roles: "+strings.Join(roles, ", "))
+
+	http.Redirect(w, r, "/admin/manage-users?success=Role+updated", http.StatusSeeOther)
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const maxRosterSize = 5 << 20 // 5 MB
+
+// Header names accepted for each roster column. Files without a header row
+// must list the columns in this order.
+var rosterColumns = [][]string{
+	{"email", "e-mail", "email address"},
+	{"name", "full name", "student name"},
+	{"student number", "student_number", "student id", "student_id", "id"},
+	{"section", "sec"},
+	{"role"},
+}
+
+// RosterEntry is one row of a roster CSV
+type RosterEntry struct {
+	Line          int
+	Email         string
+	Name          string
+	StudentNumber string
+	Section       string
+	Role          string // empty leaves an existing user's roles alone
+}
+
+// RosterChange describes what importing an entry will do to an existing user
+type RosterChange struct {
+	Entry   *RosterEntry
+	User    *User
+	Changes []string
+}
+
+// RosterPlan is the difference between a roster and the users table
+type RosterPlan struct {
+	New       []*RosterEntry
+	Changed   []*RosterChange
+	Unchanged int
+	Removed   []*User  // students in the database but not the roster
+	Errors    []string // problems that stop the import
+}
+
+type ImportRosterPage struct {
+	Error   string
+	Success string
+	CSV     string // the uploaded roster, carried from preview to commit
+	Plan    *RosterPlan
+	User    *AuthClaims
+	Nav     []NavItem
+
+	DeactivateMissing bool
+	SendEmails        bool
+}
+
+// ParseRoster reads a registrar CSV export. Columns are matched by header
+// name when the first row has an email header, and by position otherwise.
+func ParseRoster(r io.Reader) ([]*RosterEntry, []string) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, []string{fmt.Sprintf("Could not read CSV: %v", err)}
+	}
+	if len(records) == 0 {
+		return nil, []string{"The roster is empty"}
+	}
+
+	// Column index for each of rosterColumns, -1 if missing
+	index := []int{0, 1, 2, 3, 4}
+	start := 0
+	if header := records[0]; rosterColumnIndex(header, rosterColumns[0]) >= 0 {
+		for i, names := range rosterColumns {
+			index[i] = rosterColumnIndex(header, names)
+		}
+		start = 1
+	}
+
+	field := func(record []string, column int) string {
+		if i := index[column]; i >= 0 && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []*RosterEntry
+	var problems []string
+	seen := make(map[string]int)
+	for n, record := range records[start:] {
+		line := start + n + 1
+		entry := &RosterEntry{
+			Line:          line,
+			Email:         strings.ToLower(field(record, 0)),
+			Name:          field(record, 1),
+			StudentNumber: field(record, 2),
+			Section:       field(record, 3),
+			Role:          strings.ToLower(field(record, 4)),
+		}
+		if entry.Email == "" && entry.Name == "" && entry.StudentNumber == "" {
+			continue // blank line
+		}
+		if !strings.Contains(entry.Email, "@") || !strings.Contains(entry.Email, ".") {
+			problems = append(problems, fmt.Sprintf("Line %d: invalid email address %q", line, entry.Email))
+			continue
+		}
+		if prev, ok := seen[entry.Email]; ok {
+			problems = append(problems, fmt.Sprintf("Line %d: %s is already on line %d", line, entry.Email, prev))
+			continue
+		}
+		seen[entry.Email] = line
+		entries = append(entries, entry)
+	}
+	return entries, problems
+}
+
+func rosterColumnIndex(header []string, names []string) int {
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		if containsString(names, h) {
+			return i
+		}
+	}
+	return -1
+}
+
+// PlanRosterImport compares roster entries with the users table without
+// changing anything. Users holding a staff permission or admin are never
+// reported as removed, since they aren't on the registrar's roster.
+// importer is the signed-in user, whose own account the roster can't touch,
+// who needs PermRolesManage to assign roles and must be an admin to change
+// an admin; it is nil for the command line, which may change anything.
+func (am *AuthManager) PlanRosterImport(entries []*RosterEntry, importer *AuthClaims) (*RosterPlan, error) {
+	plan := &RosterPlan{}
+
+	roles, err := am.GetAllRoles()
+	if err != nil {
+		return nil, err
+	}
+	roleNames, err := am.GetUserRoleNames()
+	if err != nil {
+		return nil, err
+	}
+
+	inRoster := make(map[string]bool)
+	for _, entry := range entries {
+		inRoster[entry.Email] = true
+
+		if entry.Role != "" && !containsRole(roles, entry.Role) {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("Line %d: unknown role %q", entry.Line, entry.Role))
+			continue
+		}
+		if entry.Role != "" && importer != nil && !importer.Can(PermRolesManage) {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("Line %d: assigning roles needs the %s permission", entry.Line, PermRolesManage))
+			continue
+		}
+
+		user, err := am.GetUserByEmail(entry.Email)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			plan.New = append(plan.New, entry)
+			continue
+		}
+		if importer != nil && user.ID == importer.UserID {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("Line %d: %s is your own account, which you can't change by importing a roster", entry.Line, user.Email))
+			continue
+		}
+		if importer != nil && user.IsAdmin && !importer.IsAdmin {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("Line %d: %s is an admin, whom only admins can change", entry.Line, user.Email))
+			continue
+		}
+
+		var changes []string
+		if entry.Name != "" && entry.Name != user.Name {
+			changes = append(changes, fmt.Sprintf("name %q → %q", user.Name, entry.Name))
+		}
+		if entry.StudentNumber != "" && entry.StudentNumber != user.StudentNumber {
+			changes = append(changes, fmt.Sprintf("student number %q → %q", user.StudentNumber, entry.StudentNumber))
+		}
+		if entry.Section != "" && entry.Section != user.Section {
+			changes = append(changes, fmt.Sprintf("section %q → %q", user.Section, entry.Section))
+		}
+		if current := roleNames[user.ID]; entry.Role != "" && !(len(current) == 1 && current[0] == entry.Role) {
+			changes = append(changes, fmt.Sprintf("role %q → %q", strings.Join(current, ", "), entry.Role))
+		}
+		if user.Disabled {
+			changes = append(changes, "re-enable account")
+		}
+
+		if len(changes) == 0 {
+			plan.Unchanged++
+		} else {
+			plan.Changed = append(plan.Changed, &RosterChange{Entry: entry, User: user, Changes: changes})
+		}
+	}
+
+	users, err := am.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if inRoster[strings.ToLower(user.Email)] || user.IsAdmin || user.Disabled {
+			continue
+		}
+		permissions, err := am.GetUserPermissions(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(permissions) > 0 {
+			continue
+		}
+		plan.Removed = append(plan.Removed, user)
+	}
+
+	return plan, nil
+}
+
+// ApplyRosterImport carries out a plan in one transaction, so a failure
+// leaves the users table as it was. Users missing from the roster are
+// disabled only if deactivateMissing is set; the plan never includes admins
+// or staff there. It returns the newly created users so the caller can send
+// their setup emails.
+func (am *AuthManager) ApplyRosterImport(plan *RosterPlan, deactivateMissing bool) ([]*User, error) {
+	if len(plan.Errors) > 0 {
+		return nil, fmt.Errorf("the roster has errors")
+	}
+
+	roles, err := am.GetAllRoles()
+	if err != nil {
+		return nil, err
+	}
+	roleIDs := func(name string) []int {
+		for _, role := range roles {
+			if role.Name == name {
+				return []int{role.ID}
+			}
+		}
+		return nil
+	}
+
+	var created []*User
+	err = am.inTx(func(tx *Tx, users UserStore) error {
+		for _, entry := range plan.New {
+			user, err := createUser(users, entry.Email, false)
+			if err != nil {
+				return err
+			}
+			if err := users.SetRosterInfo(user.ID, entry.Name, entry.StudentNumber, entry.Section); err != nil {
+				return err
+			}
+			if entry.Role != "" {
+				if err := setUserRoleIDs(tx, user.ID, roleIDs(entry.Role)); err != nil {
+					return err
+				}
+			}
+			created = append(created, user)
+		}
+
+		for _, change := range plan.Changed {
+			entry, user := change.Entry, change.User
+			name, studentNumber, section := user.Name, user.StudentNumber, user.Section
+			if entry.Name != "" {
+				name = entry.Name
+			}
+			if entry.StudentNumber != "" {
+				studentNumber = entry.StudentNumber
+			}
+			if entry.Section != "" {
+				section = entry.Section
+			}
+			if err := users.SetRosterInfo(user.ID, name, studentNumber, section); err != nil {
+				return err
+			}
+			if entry.Role != "" {
+				if err := setUserRoleIDs(tx, user.ID, roleIDs(entry.Role)); err != nil {
+					return err
+				}
+			}
+			if user.Disabled {
+				if err := users.SetDisabled(user.ID, false); err != nil {
+					return err
+				}
+			}
+		}
+
+		if deactivateMissing {
+			for _, user := range plan.Removed {
+				if err := users.SetDisabled(user.ID, true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (am *AuthManager) SetUserRosterInfo(userID int, name, studentNumber, section string) error {
+	return am.users.SetRosterInfo(userID, name, studentNumber, section)
+}
+
+func containsRole(roles []*Role, name string) bool {
+	for _, role := range roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Roster import: upload a CSV to preview the changes, then confirm them.
+// The preview page carries the CSV in a hidden field so nothing is stored
+// between the two steps.
+func handleImportRoster(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	if !userClaims.Can(PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	page := ImportRosterPage{User: userClaims, Nav: config.navItems, SendEmails: !config.LDAP.Enabled()}
+
+	if r.Method == "POST" {
+		// CSRFProtect leaves multipart bodies unread, so this limit is what
+		// bounds an upload
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+		if err := r.ParseMultipartForm(maxRosterSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				page.Error = fmt.Sprintf("The roster is too large; the limit is %d MB", maxRosterSize>>20)
+			} else {
+				page.Error = "Could not read the upload"
+			}
+			renderImportRosterPage(w, page)
+			return
+		}
+		action := r.FormValue("action")
+
+		if action == "preview" {
+			file, _, err := r.FormFile("roster")
+			if err != nil {
+				page.Error = "Choose a CSV file to upload"
+				renderImportRosterPage(w, page)
+				return
+			}
+			defer file.Close()
+			data, err := io.ReadAll(io.LimitReader(file, maxRosterSize+1))
+			if err != nil {
+				page.Error = "Could not read the uploaded file"
+				renderImportRosterPage(w, page)
+				return
+			}
+			if len(data) > maxRosterSize {
+				page.Error = fmt.Sprintf("The roster is too large; the limit is %d MB", maxRosterSize>>20)
+				renderImportRosterPage(w, page)
+				return
+			}
+			page.CSV = string(data)
+		} else if action == "commit" {
+			page.CSV = r.FormValue("csv")
+			page.DeactivateMissing = r.FormValue("deactivate_missing") == "on"
+			page.SendEmails = r.FormValue("send_emails") == "on"
+		} else {
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+
+		entries, problems := ParseRoster(strings.NewReader(page.CSV))
+		plan, err := authManager.PlanRosterImport(entries, userClaims)
+		if err != nil {
+			panicf("Error planning roster import: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		plan.Errors = append(problems, plan.Errors...)
+		page.Plan = plan
+
+		if action == "commit" {
+			if len(plan.Errors) > 0 {
+				page.Error = "Fix the errors in the roster and upload it again"
+				renderImportRosterPage(w, page)
+				return
+			}
+
+			created, err := authManager.ApplyRosterImport(plan, page.DeactivateMissing)
+			if err != nil {
+				log.Printf("Error importing roster: %v", err)
+				page.Error = "Import failed, so nothing was changed: " + err.Error()
+				renderImportRosterPage(w, page)
+				return
+			}
+
+			for _, user := range created {
+				authManager.Audit(r, AuditUserCreate, user.Email, "roster import")
+			}
+			if page.SendEmails {
+				for _, user := range created {
+					if err := authManager.SendSetupEmail(user, baseURL(r)); err != nil {
+						log.Printf("Error queueing setup email to %s: %v", user.Email, err)
+					}
+				}
+			}
+
+			message := fmt.Sprintf("Roster imported: %d added, %d updated", len(plan.New), len(plan.Changed))
+			if page.DeactivateMissing {
+				message += fmt.Sprintf(", %d disabled", len(plan.Removed))
+			}
+			authManager.Audit(r, AuditRosterImport, "", message)
+			redirectManageUsers(w, r, "success", message)
+			return
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	renderImportRosterPage(w, page)
+}
+
+func renderImportRosterPage(w http.ResponseWriter, page ImportRosterPage) {
+	if err := config.templates.ExecuteTemplate(w, "admin-import-roster.html", page); err != nil {
+		panicf("Error executing import roster template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
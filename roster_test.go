@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func planRoster(t *testing.T, csv string, importer *AuthClaims) *RosterPlan {
+	entries, problems := ParseRoster(strings.NewReader(csv))
+	if len(problems) > 0 {
+		t.Fatalf("parsing the roster: %v", problems)
+	}
+	plan, err := authManager.PlanRosterImport(entries, importer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func TestPlanRosterImportPermissions(t *testing.T) {
+	setupTest(t, ServerConfig{})
+	ta := newTestUser(t, "ta@example.edu", false)
+	newTestUser(t, "student@example.edu", false)
+	newTestUser(t, "admin@example.edu", true)
+	taClaims := &AuthClaims{UserID: ta.ID, Email: ta.Email, Permissions: []string{PermUsersManage}}
+	instructorClaims := &AuthClaims{UserID: ta.ID, Email: ta.Email, Permissions: []string{PermUsersManage, PermRolesManage}}
+	adminClaims := &AuthClaims{UserID: ta.ID, Email: ta.Email, IsAdmin: true}
+
+	tests := []struct {
+		name     string
+		csv      string
+		importer *AuthClaims
+		wantErr  string
+	}{
+		{"plain row", "email,name\nstudent@example.edu,Sam\n", taClaims, ""},
+		{"role without roles.manage", "email,role\nstudent@example.edu,instructor\n", taClaims, "needs the roles.manage permission"},
+		{"role on a new user", "email,role\nnew@example.edu,instructor\n", taClaims, "needs the roles.manage permission"},
+		{"role with roles.manage", "email,role\nstudent@example.edu,instructor\n", instructorClaims, ""},
+		{"own account", "email,name\nTA@example.edu,Me\n", taClaims, "your own account"},
+		{"own role", "email,role\nta@example.edu,instructor\n", instructorClaims, "your own account"},
+		{"admin by non-admin", "email,name\nadmin@example.edu,Root\n", instructorClaims, "only admins can change"},
+		{"admin by admin", "email,name\nadmin@example.edu,Root\n", adminClaims, ""},
+		{"command line", "email,role\nta@example.edu,instructor\n", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planRoster(t, tt.csv, tt.importer)
+			got := strings.Join(plan.Errors, "\n")
+			if tt.wantErr == "" && got != "" {
+				t.Errorf("unexpected errors: %s", got)
+			}
+			if !strings.Contains(got, tt.wantErr) {
+				t.Errorf("errors %q don't mention %q", got, tt.wantErr)
+			}
+			if tt.wantErr != "" && len(plan.New)+len(plan.Changed) > 0 {
+				t.Errorf("a rejected row was planned: %d new, %d changed", len(plan.New), len(plan.Changed))
+			}
+		})
+	}
+}
+
+func TestImportRosterUploadLimit(t *testing.T) {
+	setupTest(t, ServerConfig{})
+	admin := newTestUser(t, "admin@example.edu", true)
+	claims := &AuthClaims{UserID: admin.ID, Email: admin.Email, IsAdmin: true}
+	handler := CSRFProtect(http.HandlerFunc(handleImportRoster))
+
+	upload := func(roster string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("action", "preview")
+		part, _ := form.CreateFormFile("roster", "roster.csv")
+		part.Write([]byte(roster))
+		form.Close()
+
+		req := httptest.NewRequest("POST", "http://app.test/admin/import-roster", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Origin", "http://app.test")
+		req = req.WithContext(WithUserContext(req.Context(), claims))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := upload("email\nnew@example.edu\n"); !strings.Contains(rec.Body.String(), "new@example.edu") {
+		t.Errorf("a small roster wasn't previewed: status %d", rec.Code)
+	}
+	for _, size := range []int{maxRosterSize + 1, maxFormSize + 1} {
+		rec := upload("email\n" + strings.Repeat("x", size))
+		if !strings.Contains(rec.Body.String(), "The roster is too large") {
+			t.Errorf("a %d byte roster was accepted: status %d", size, rec.Code)
+		}
+	}
+}
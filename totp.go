@@ -0,0 +1,338 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults understood by every
+// common authenticator app, so they are not configurable.
+const (
+	totpPeriod            = 30 // seconds per time step
+	totpDigits            = 6
+	totpSkew              = 1 // accept codes from one step either side of now
+	totpIssuer            = "COMP 3007"
+	totpMaxFailures       = 5
+	totpLockout           = 15 * time.Minute
+	recoveryCodeCount     = 10
+	loginChallengeTimeout = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ErrTOTPEnabled is returned when enrollment is started for a user who
+// already has two-factor login. They must disable it, which takes their
+// password, before enrolling a new authenticator.
+var ErrTOTPEnabled = errors.New("two-factor authentication is already enabled")
+
+// TOTPEnrollment holds what the user needs to add the account to an
+// authenticator app before confirming enrollment with a first code.
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+	QRCode template.URL // PNG data URI
+}
+
+func (am *AuthManager) TOTPEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := am.db.QueryRow(`SELECT enabled FROM user_totp WHERE user_id = ?`, userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// BeginTOTPEnrollment generates a fresh secret for the user and stores it as
+// pending. Two-factor login is not required until ConfirmTOTPEnrollment
+// succeeds. An enabled secret is never replaced; that returns ErrTOTPEnabled.
+func (am *AuthManager) BeginTOTPEnrollment(user *User) (*TOTPEnrollment, error) {
+	secretBytes := make([]byte, 20)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	secret := totpEncoding.EncodeToString(secretBytes)
+
+	result, err := am.db.Exec(`
+		INSERT INTO user_totp (user_id, secret, enabled, last_used_step)
+		VALUES (?, ?, FALSE, 0)
+		ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, last_used_step = 0
+		WHERE user_totp.enabled = FALSE
+	`, user.ID, secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store TOTP secret: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrTOTPEnabled
+	}
+
+	return newTOTPEnrollment(user.Email, secret)
+}
+
+// PendingTOTPEnrollment returns the enrollment started by
+// BeginTOTPEnrollment, so a mistyped confirmation code doesn't force the
+// user to scan a new QR code.
+func (am *AuthManager) PendingTOTPEnrollment(user *User) (*TOTPEnrollment, error) {
+	var secret string
+	err := am.db.QueryRow(`SELECT secret FROM user_totp WHERE user_id = ? AND enabled = FALSE`, user.ID).Scan(&secret)
+	if err != nil {
+		return nil, err
+	}
+	return newTOTPEnrollment(user.Email, secret)
+}
+
+// ConfirmTOTPEnrollment enables two-factor login once the user proves their
+// authenticator app produces valid codes. It returns a fresh set of recovery
+// codes, which are only ever shown this once.
+func (am *AuthManager) ConfirmTOTPEnrollment(userID int, code string) ([]string, error) {
+	var secret string
+	err := am.db.QueryRow(`SELECT secret FROM user_totp WHERE user_id = ? AND enabled = FALSE`, userID).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no pending two-factor enrollment")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	step, ok := verifyTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, fmt.Errorf("invalid verification code")
+	}
+
+	_, err = am.db.Exec(`
+		UPDATE user_totp SET enabled = TRUE, last_used_step = ?, failed_attempts = 0, locked_until = NULL
+		WHERE user_id = ?
+	`, step, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %w", err)
+	}
+
+	return am.RegenerateRecoveryCodes(userID)
+}
+
+func (am *AuthManager) DisableTOTP(userID int) error {
+	if _, err := am.db.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	if _, err := am.db.Exec(`DELETE FROM user_totp WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces all of the user's recovery codes. Only
+// SHA-256 hashes are stored; the codes are random enough that a slow hash
+// buys nothing.
+func (am *AuthManager) RegenerateRecoveryCodes(userID int) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+	}
+
+	if _, err := am.db.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	for _, code := range codes {
+		_, err := am.db.Exec(`INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)`,
+			userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused
+// recovery code. Repeated failures lock the second step for a while so the
+// six-digit code space cannot be brute forced.
+func (am *AuthManager) VerifySecondFactor(userID int, code string) error {
+	var secret string
+	var lastStep int64
+	var lockedUntil sql.NullTime
+	err := am.db.QueryRow(`
+		SELECT secret, last_used_step, locked_until
+		FROM user_totp WHERE user_id = ? AND enabled = TRUE
+	`, userID).Scan(&secret, &lastStep, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("two-factor authentication not enabled")
+	}
+	if err != nil {
+		return err
+	}
+
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		return fmt.Errorf("too many failed attempts, try again later")
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTOTP(secret, code, time.Now()); ok && step > lastStep {
+		// Checking the step again in the update stops two requests racing
+		// to use the same code
+		result, err := am.db.Exec(`
+			UPDATE user_totp SET last_used_step = ?, failed_attempts = 0, locked_until = NULL
+			WHERE user_id = ? AND last_used_step < ?
+		`, step, userID, step)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return nil
+		}
+	}
+
+	result, err := am.db.Exec(`
+		UPDATE totp_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		_, err := am.db.Exec(`UPDATE user_totp SET failed_attempts = 0, locked_until = NULL WHERE user_id = ?`, userID)
+		return err
+	}
+
+	// Counting in the database, rather than writing back a count read
+	// earlier, means concurrent guesses can't overwrite each other's failures
+	var failures int
+	err = am.db.QueryRow(`
+		UPDATE user_totp SET failed_attempts = failed_attempts + 1
+		WHERE user_id = ? RETURNING failed_attempts
+	`, userID).Scan(&failures)
+	if err != nil {
+		return err
+	}
+	if failures >= totpMaxFailures {
+		_, err = am.db.Exec(`UPDATE user_totp SET failed_attempts = 0, locked_until = ? WHERE user_id = ?`,
+			time.Now().Add(totpLockout), userID)
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("invalid verification code")
+}
+
+func (am *AuthManager) RemainingRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := am.db.QueryRow(`SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id = ? AND used_at IS NULL`,
+		userID).Scan(&count)
+	return count, err
+}
+
+// GenerateLoginChallenge issues a short-lived token proving that the user
+// has already passed the password step. It is signed with a key derived from
+// the JWT secret so it can never be mistaken for a session token.
+func (am *AuthManager) GenerateLoginChallenge(user *User) (string, error) {
+	claims := jwt.RegisteredClaims{
+		Subject:   strconv.Itoa(user.ID),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(loginChallengeTimeout)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(am.purposeKey("login-2fa"))
+}
+
+func (am *AuthManager) ValidateLoginChallenge(tokenString string) (int, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return am.purposeKey("login-2fa"), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(claims.Subject)
+}
+
+// purposeKey derives a signing key for tokens that must not be
+// interchangeable with session JWTs.
+func (am *AuthManager) purposeKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, am.jwtSecret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newTOTPEnrollment(email, secret string) (*TOTPEnrollment, error) {
+	uri := totpURI(email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render QR code: %w", err)
+	}
+
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    uri,
+		QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+	}, nil
+}
+
+func totpURI(email, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// verifyTOTP checks code against the steps around now and returns the
+// matching step so callers can reject replays.
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code)))
+}
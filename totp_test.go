@@ -0,0 +1,74 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySecondFactor(t *testing.T) {
+	// Codes are named: "now" and "next" are the TOTP codes for the current
+	// and next time step, "recovery" is the first recovery code, and
+	// "wrong" is never valid.
+	type attempt struct {
+		code    string
+		wantErr string // empty for success
+	}
+	wrong := func(n int) []attempt {
+		attempts := make([]attempt, n)
+		for i := range attempts {
+			attempts[i] = attempt{"wrong", "invalid verification code"}
+		}
+		return attempts
+	}
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{"valid code", []attempt{{"now", ""}}},
+		{"replayed step", []attempt{{"now", ""}, {"now", "invalid verification code"}}},
+		{"earlier step after a later one", []attempt{{"next", ""}, {"now", "invalid verification code"}}},
+		{"recovery code", []attempt{{"recovery", ""}}},
+		{"recovery code used twice", []attempt{{"recovery", ""}, {"recovery", "invalid verification code"}}},
+		{"lockout", append(wrong(totpMaxFailures), attempt{"now", "too many failed attempts"})},
+		{"success resets failures", append(append(append(wrong(totpMaxFailures-1), attempt{"now", ""}),
+			wrong(totpMaxFailures-1)...), attempt{"next", ""})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t, ServerConfig{})
+			user := newTestUser(t, "student@example.edu", false)
+			enrollment, err := authManager.BeginTOTPEnrollment(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := totpEncoding.DecodeString(enrollment.Secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Confirming with the previous step's code leaves this step and
+			// the next unused
+			current := time.Now().Unix() / totpPeriod
+			recoveryCodes, err := authManager.ConfirmTOTPEnrollment(user.ID, totpCode(key, uint64(current-1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			codes := map[string]string{
+				"now":      totpCode(key, uint64(current)),
+				"next":     totpCode(key, uint64(current+1)),
+				"recovery": recoveryCodes[0],
+				"wrong":    "not a code",
+			}
+
+			for i, a := range tt.attempts {
+				err := authManager.VerifySecondFactor(user.ID, codes[a.code])
+				if a.wantErr == "" && err != nil {
+					t.Errorf("attempt %d (%s): %v", i+1, a.code, err)
+				}
+				if a.wantErr != "" && (err == nil || !strings.Contains(err.Error(), a.wantErr)) {
+					t.Errorf("attempt %d (%s): got %v, want %q", i+1, a.code, err, a.wantErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const usersUsage = `usage:
+  server users list [--json] <config file>
+  server users add [--admin] [--send-email] [--json] <email> <config file>
+  server users import [--dry-run] [--deactivate-missing] [--send-emails] [--json] <roster.csv> <config file>
+  server users reset-password [--send-email] [--json] <email> <config file>
+  server users setup-link [--send-email] [--json] <email> <config file>
+  server users disable|enable [--json] <email> <config file>
+Flags must come before the other arguments. With --json, errors are printed
+as {"error": "..."} as well.`
+
+var usersCommands = []string{"list", "add", "import", "reset-password", "setup-link", "disable", "enable"}
+
+// Actions taken by these commands are audited with this in their details,
+// and no actor
+const commandLineDetail = "from the command line"
+
+// UserSetupLink is the --json output of commands that issue a setup link
+type UserSetupLink struct {
+	User     *User  `json:"user"`
+	SetupURL string `json:"setup_url"`
+}
+
+// RosterImportResult is the --json output of "users import"
+type RosterImportResult struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Missing []string `json:"missing"` // students not on the roster, disabled with --deactivate-missing
+	Errors  []string `json:"errors"`
+	DryRun  bool     `json:"dry_run"`
+}
+
+// Users runs the "users" command, which manages accounts without a browser
+// session. args are the arguments after "users"; the last is always the
+// server config file. Output is for people unless --json is given, in which
+// case errors are also written to out as {"error": "..."}.
+func Users(args []string, out io.Writer) error {
+	err := runUsers(args, out)
+	if err != nil && jsonRequested(args) {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(map[string]string{"error": err.Error()})
+	}
+	return err
+}
+
+// jsonRequested looks for --json anywhere in args, so that even usage
+// errors, such as a flag after the positional arguments, come out as JSON
+func jsonRequested(args []string) bool {
+	for _, arg := range args {
+		name, value, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && name == "json" && value != "false" {
+			return true
+		}
+	}
+	return false
+}
+
+func runUsers(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", usersUsage)
+	}
+	command := args[0]
+	if !containsString(usersCommands, command) {
+		return fmt.Errorf("unknown users command %q\n%s", command, usersUsage)
+	}
+
+	flags := flag.NewFlagSet("users "+command, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	asJSON := flags.Bool("json", false, "")
+	admin := flags.Bool("admin", false, "")
+	sendEmail := flags.Bool("send-email", false, "")
+	sendEmails := flags.Bool("send-emails", false, "")
+	dryRun := flags.Bool("dry-run", false, "")
+	deactivateMissing := flags.Bool("deactivate-missing", false, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		return fmt.Errorf("%v\n%s", err, usersUsage)
+	}
+
+	// Every command but list takes one argument before the config file
+	want := 2
+	if command == "list" {
+		want = 1
+	}
+	if flags.NArg() != want {
+		for _, extra := range flags.Args() {
+			if strings.HasPrefix(extra, "-") {
+				return fmt.Errorf("%s must come before the other arguments\n%s", extra, usersUsage)
+			}
+		}
+		return fmt.Errorf("%s", usersUsage)
+	}
+	arg := flags.Arg(0)
+
+	am, err := openForCommand(flags.Arg(want - 1))
+	if err != nil {
+		return err
+	}
+	defer am.db.Close()
+
+	output := func(v any, text string) error {
+		if *asJSON {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			return enc.Encode(v)
+		}
+		_, err := fmt.Fprint(out, text)
+		return err
+	}
+
+	switch command {
+	case "list":
+		users, err := am.usersWithRoles()
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tEMAIL\tNAME\tSTATUS\tROLES")
+		for _, user := range users {
+			roles := user.Roles
+			if user.IsAdmin {
+				roles = append([]string{"admin"}, roles...)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", user.ID, user.Email, user.Name, userStatus(user), strings.Join(roles, ","))
+		}
+		tw.Flush()
+		if users == nil {
+			users = []*User{}
+		}
+		return output(users, b.String())
+
+	case "add":
+		email := strings.ToLower(strings.TrimSpace(arg))
+		if !isValidEmail(email) {
+			return fmt.Errorf("invalid email address: %q", arg)
+		}
+		if existing, err := am.GetUserByEmail(email); err != nil {
+			return err
+		} else if existing != nil {
+			return fmt.Errorf("%s already has an account", email)
+		}
+		user, err := am.CreateUser(email, *admin)
+		if err != nil {
+			return err
+		}
+		details := commandLineDetail
+		if *admin {
+			details = "administrator, " + details
+		}
+		am.AuditAs(nil, 0, "", AuditUserCreate, user.Email, details)
+		return am.printSetupLink(user, *sendEmail, "Created "+user.Email, output)
+
+	case "import":
+		return am.importRosterFile(arg, *dryRun, *deactivateMissing, *sendEmails, output)
+
+	case "reset-password", "setup-link":
+		user, err := am.GetUserByEmail(strings.TrimSpace(arg))
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("no account for %s", arg)
+		}
+		if user.Disabled {
+			return fmt.Errorf("%s is disabled", user.Email)
+		}
+		if command == "setup-link" && user.IsSetup {
+			return fmt.Errorf("%s has already set up their account; use reset-password", user.Email)
+		}
+		if user.SetupToken, err = am.RegenerateSetupToken(user.ID); err != nil {
+			return err
+		}
+		am.AuditAs(nil, 0, "", AuditSetupEmail, user.Email, command+", "+commandLineDetail)
+		return am.printSetupLink(user, *sendEmail, "New link for "+user.Email, output)
+
+	case "disable", "enable":
+		user, err := am.GetUserByEmail(strings.TrimSpace(arg))
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("no account for %s", arg)
+		}
+		if err := am.SetUserDisabled(user.ID, command == "disable"); err != nil {
+			return err
+		}
+		user.Disabled = command == "disable"
+		am.AuditAs(nil, 0, "", AuditUserUpdate, user.Email, command+"d, "+commandLineDetail)
+		return output(user, fmt.Sprintf("%s %sd\n", user.Email, command))
+	}
+
+	return fmt.Errorf("unknown users command %q", command)
+}
+
+// usersWithRoles is GetAllUsers with each user's roles filled in
+func (am *AuthManager) usersWithRoles() ([]*User, error) {
+	users, err := am.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	roleNames, err := am.GetUserRoleNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		user.Roles = roleNames[user.ID]
+	}
+	return users, nil
+}
+
+func userStatus(user *User) string {
+	switch {
+	case user.Disabled:
+		return "disabled"
+	case !user.IsSetup:
+		return "pending"
+	}
+	return "active"
+}
+
+// printSetupLink prints the setup link of a user who has just been issued a
+// setup token, and emails it to them if sendEmail is set
+func (am *AuthManager) printSetupLink(user *User, sendEmail bool, heading string, output func(any, string) error) error {
+	setupURL := fmt.Sprintf("%s/setup?token=%s", startupBaseURL(), user.SetupToken)
+	if sendEmail {
+		send := am.SendSetupEmail
+		if user.IsSetup {
+			send = am.SendPasswordResetEmail
+		}
+		if err := send(user, startupBaseURL()); err != nil {
+			return fmt.Errorf("failed to queue setup email to %s: %w", user.Email, err)
+		}
+		heading += " and queued an email to them"
+	}
+	text := fmt.Sprintf("%s. The setup link expires in %s:\n%s\n", heading, describeDuration(setupTokenLifetime()), setupURL)
+	return output(UserSetupLink{User: user, SetupURL: setupURL}, text)
+}
+
+// importRosterFile imports a roster CSV the way the Import Roster page does,
+// reporting the plan instead of previewing it
+func (am *AuthManager) importRosterFile(path string, dryRun, deactivateMissing, sendEmails bool, output func(any, string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries, problems := ParseRoster(io.LimitReader(file, maxRosterSize))
+	plan, err := am.PlanRosterImport(entries, nil)
+	if err != nil {
+		return err
+	}
+	plan.Errors = append(problems, plan.Errors...)
+
+	result := RosterImportResult{Added: []string{}, Updated: []string{}, Missing: []string{}, Errors: plan.Errors, DryRun: dryRun}
+	for _, entry := range plan.New {
+		result.Added = append(result.Added, entry.Email)
+	}
+	for _, change := range plan.Changed {
+		result.Updated = append(result.Updated, change.User.Email)
+	}
+	for _, user := range plan.Removed {
+		result.Missing = append(result.Missing, user.Email)
+	}
+	if result.Errors == nil {
+		result.Errors = []string{}
+	}
+
+	var b strings.Builder
+	if len(plan.Errors) > 0 {
+		for _, problem := range plan.Errors {
+			fmt.Fprintln(&b, problem)
+		}
+		if err := output(result, b.String()); err != nil {
+			return err
+		}
+		return fmt.Errorf("the roster has errors; nothing was imported")
+	}
+
+	for _, email := range result.Added {
+		fmt.Fprintln(&b, "add", email)
+	}
+	for _, change := range plan.Changed {
+		fmt.Fprintf(&b, "update %s: %s\n", change.User.Email, strings.Join(change.Changes, "; "))
+	}
+	verb := "disable"
+	if !deactivateMissing {
+		verb = "not on roster, kept"
+	}
+	for _, email := range result.Missing {
+		fmt.Fprintln(&b, verb, email)
+	}
+	message := fmt.Sprintf("Roster imported: %d added, %d updated", len(plan.New), len(plan.Changed))
+	if deactivateMissing {
+		message += fmt.Sprintf(", %d disabled", len(plan.Removed))
+	}
+	if dryRun {
+		fmt.Fprintf(&b, "Dry run: %d to add, %d to update, %d unchanged\n", len(plan.New), len(plan.Changed), plan.Unchanged)
+		return output(result, b.String())
+	}
+	created, err := am.ApplyRosterImport(plan, deactivateMissing)
+	if err != nil {
+		return fmt.Errorf("import failed, so nothing was changed: %w", err)
+	}
+	for _, user := range created {
+		am.AuditAs(nil, 0, "", AuditUserCreate, user.Email, "roster import, "+commandLineDetail)
+		if sendEmails {
+			if err := am.SendSetupEmail(user, startupBaseURL()); err != nil {
+				fmt.Fprintf(os.Stderr, "Error queueing setup email to %s: %v\n", user.Email, err)
+			}
+		}
+	}
+	am.AuditAs(nil, 0, "", AuditRosterImport, "", message+", "+commandLineDetail)
+
+	fmt.Fprintln(&b, message)
+	return output(result, b.String())
+}
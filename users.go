@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var ErrLastAdmin = errors.New("can't remove the last active admin")
+
+// checkNotLastAdmin returns ErrLastAdmin if userID is the only enabled
+// admin, so disabling, deleting or demoting them would lock everyone out.
+// users should be the store of the transaction making the change, so the
+// count still holds when it commits.
+func checkNotLastAdmin(users UserStore, userID int) error {
+	others, err := users.CountActiveAdmins(userID)
+	if err != nil {
+		return err
+	}
+	if others > 0 {
+		return nil
+	}
+
+	user, err := users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user != nil && user.IsAdmin && !user.Disabled {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// SetUserDisabled disables or re-enables an account. Disabled users keep
+// their data but can't sign in, and their sessions and API tokens stop
+// working.
+func (am *AuthManager) SetUserDisabled(userID int, disabled bool) error {
+	return am.inTx(func(tx *Tx, users UserStore) error {
+		if disabled {
+			if err := checkNotLastAdmin(users, userID); err != nil {
+				return err
+			}
+		}
+		return users.SetDisabled(userID, disabled)
+	})
+}
+
+// DeleteUser removes a user and everything that belongs to them
+func (am *AuthManager) DeleteUser(userID int) error {
+	return am.inTx(func(tx *Tx, users UserStore) error {
+		if err := checkNotLastAdmin(users, userID); err != nil {
+			return err
+		}
+		return users.DeleteUser(userID)
+	})
+}
+
+// isValidEmail is the basic check made wherever an email address is entered
+func isValidEmail(email string) bool {
+	return strings.Contains(email, "@") && strings.Contains(email, ".")
+}
+
+func (am *AuthManager) UpdateUserEmail(userID int, email string) error {
+	email = strings.TrimSpace(email)
+	if !isValidEmail(email) {
+		return fmt.Errorf("invalid email address: %s", email)
+	}
+
+	existing, err := am.GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.ID != userID {
+		return fmt.Errorf("email %s is already used by another account", email)
+	}
+
+	return am.users.SetEmail(userID, email)
+}
+
+// Disable, enable, delete, promote or demote a user, or change their email,
+// from the manage users page
+func handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	userClaims := GetUserFromContext(r.Context())
+	if !userClaims.Can(PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	user, err := authManager.GetUserByID(userID)
+	if err != nil || user == nil {
+		http.Error(w, "User not found", http.StatusBadRequest)
+		return
+	}
+
+	action := r.FormValue("action")
+
+	// Only admins may change admin accounts or who is an admin
+	if (user.IsAdmin || action == "promote" || action == "demote") && !userClaims.IsAdmin {
+		redirectManageUsers(w, r, "error", "Only administrators can change administrator accounts")
+		return
+	}
+	if user.ID == userClaims.UserID && (action == "disable" || action == "delete" || action == "demote") {
+		redirectManageUsers(w, r, "error", "You can't "+action+" your own account")
+		return
+	}
+
+	var success string
+	switch action {
+	case "disable":
+		err = authManager.SetUserDisabled(user.ID, true)
+		success = user.Email + " disabled"
+	case "enable":
+		err = authManager.SetUserDisabled(user.ID, false)
+		success = user.Email + " enabled"
+	case "delete":
+		err = authManager.DeleteUser(user.ID)
+		success = user.Email + " deleted"
+	case "promote":
+		err = authManager.SetUserAdmin(user.ID, true)
+		success = user.Email + " is now an administrator"
+	case "demote":
+		err = authManager.SetUserAdmin(user.ID, false)
+		success = user.Email + " is no longer an administrator"
+	case "email":
+		email := strings.TrimSpace(r.FormValue("email"))
+		err = authManager.UpdateUserEmail(user.ID, email)
+		success = "Email changed from " + user.Email + " to " + email
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		redirectManageUsers(w, r, "error", Capitalize(err.Error()))
+		return
+	}
+	authManager.Audit(r, AuditUserUpdate, user.Email, success)
+	redirectManageUsers(w, r, "success", success)
+}
+
+func redirectManageUsers(w http.ResponseWriter, r *http.Request, key, msg string) {
+	http.Redirect(w, r, "/admin/manage-users?"+url.Values{key: {msg}}.Encode(), http.StatusSeeOther)
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLastAdminProtected(t *testing.T) {
+	changes := []struct {
+		name   string
+		change func(userID int) error
+	}{
+		{"disable", func(id int) error { return authManager.SetUserDisabled(id, true) }},
+		{"delete", func(id int) error { return authManager.DeleteUser(id) }},
+		{"demote", func(id int) error { return authManager.SetUserAdmin(id, false) }},
+	}
+	for _, c := range changes {
+		t.Run(c.name, func(t *testing.T) {
+			setupTest(t, ServerConfig{})
+			admin := newTestUser(t, "admin@example.edu", true)
+			other := newTestUser(t, "other@example.edu", true)
+
+			if err := c.change(other.ID); err != nil {
+				t.Fatalf("with another admin: %v", err)
+			}
+			if err := c.change(admin.ID); !errors.Is(err, ErrLastAdmin) {
+				t.Errorf("the last admin: got %v, want ErrLastAdmin", err)
+			}
+			if n, _ := authManager.users.CountActiveAdmins(0); n != 1 {
+				t.Errorf("%d active admins left, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrUserNotFound      = errors.New("user not found")
+	ErrInvalidSetupToken = errors.New("invalid or expired setup token")
+)
+
+// UserStore keeps user accounts. AuthManager reaches the users table only
+// through it; sqlUserStore serves SQLite and Postgres, and memoryUserStore
+// is for tests.
+type UserStore interface {
+	// CreateUser inserts user and sets its ID. setupTokenHash may be empty
+	// for users who are already set up.
+	CreateUser(user *User, setupTokenHash string) error
+
+	// The Get methods return nil, nil if there is no such user
+	GetUserByID(id int) (*User, error)
+	GetUserByEmail(email string) (*User, error)         // ignoring case
+	GetUserBySetupTokenHash(hash string) (*User, error) // unexpired tokens only
+	GetAllUsers() ([]*User, error)                      // newest first
+
+	CountUsers() (int, error)
+	CountActiveAdmins(exceptID int) (int, error) // enabled admins other than exceptID
+
+	// CompleteSetup sets the password of the user holding an unexpired
+	// setup token and uses the token up. It returns ErrInvalidSetupToken if
+	// no one holds it.
+	CompleteSetup(setupTokenHash, passwordHash string) error
+	MarkSetup(id int) error // without a password, e.g. after single sign-on
+	SetSetupToken(id int, hash string, expiry time.Time) error
+
+	SetPassword(id int, passwordHash string) error
+	SetAdmin(id int, isAdmin bool) error
+	SetDisabled(id int, disabled bool) error
+	SetEmail(id int, email string) error
+	SetProfile(id int, profile Profile) error
+	SetRosterInfo(id int, name, studentNumber, section string) error
+
+	// DeleteUser removes a user along with the rows in other tables that
+	// refer to them. It returns ErrUserNotFound if there is no such user.
+	DeleteUser(id int) error
+
+	// WithTx returns a store that makes its changes in tx, so they are
+	// committed or rolled back with the caller's other changes
+	WithTx(tx *Tx) UserStore
+}
+
+type sqlUserStore struct {
+	db *DB
+	tx *Tx // set by WithTx
+}
+
+func newSQLUserStore(db *DB) *sqlUserStore {
+	return &sqlUserStore{db: db}
+}
+
+func (s *sqlUserStore) WithTx(tx *Tx) UserStore {
+	return &sqlUserStore{db: s.db, tx: tx}
+}
+
+// q is the transaction if there is one, and otherwise the database
+func (s *sqlUserStore) q() querier {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// userColumns are the users table columns read by scanUser, in order
+const userColumns = `id, email, password, is_admin, setup_token_expiry, is_setup, is_disabled,
+	COALESCE(name, ''), COALESCE(preferred_name, ''), COALESCE(student_number, ''), COALESCE(pronouns, ''),
+	COALESCE(section, ''), created_at, updated_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	var password sql.NullString
+	var setupTokenExpiry sql.NullTime
+
+	err := row.Scan(&user.ID, &user.Email, &password, &user.IsAdmin, &setupTokenExpiry, &user.IsSetup, &user.Disabled,
+		&user.Name, &user.PreferredName, &user.StudentNumber, &user.Pronouns, &user.Section, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handle nullable fields
+	if password.Valid {
+		user.Password = password.String
+	}
+	if setupTokenExpiry.Valid {
+		user.SetupTokenExpiry = setupTokenExpiry.Time
+	}
+
+	return user, nil
+}
+
+func (s *sqlUserStore) getUser(where string, args ...any) (*User, error) {
+	user, err := scanUser(s.q().QueryRow(`SELECT `+userColumns+` FROM users WHERE `+where, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return user, err
+}
+
+func (s *sqlUserStore) CreateUser(user *User, setupTokenHash string) error {
+	var password, tokenHash, expiry any
+	if user.Password != "" {
+		password = user.Password
+	}
+	if setupTokenHash != "" {
+		tokenHash, expiry = setupTokenHash, user.SetupTokenExpiry
+	}
+
+	// RETURNING works in both SQLite and Postgres, unlike LastInsertId
+	err := s.q().QueryRow(`
+		INSERT INTO users (email, password, is_admin, is_setup, setup_token_hash, setup_token_expiry)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, user.Email, password, user.IsAdmin, user.IsSetup, tokenHash, expiry).Scan(&user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlUserStore) GetUserByID(id int) (*User, error) {
+	return s.getUser(`id = ?`, id)
+}
+
+// GetUserByEmail ignores case, preferring an exact match if accounts differ
+// only in case
+func (s *sqlUserStore) GetUserByEmail(email string) (*User, error) {
+	return s.getUser(`LOWER(email) = LOWER(?) ORDER BY email = ? DESC, id LIMIT 1`, email, email)
+}
+
+// GetUserBySetupTokenHash matches the hash in SQL. Only the SHA-256 of the
+// token is stored, so timing reveals nothing about the token itself.
+func (s *sqlUserStore) GetUserBySetupTokenHash(hash string) (*User, error) {
+	return s.getUser(`setup_token_hash = ? AND setup_token_expiry > ?`, hash, time.Now())
+}
+
+func (s *sqlUserStore) GetAllUsers() ([]*User, error) {
+	rows, err := s.q().Query(`SELECT ` + userColumns + ` FROM users ORDER BY created_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlUserStore) CountUsers() (int, error) {
+	var count int
+	err := s.q().QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+	return count, err
+}
+
+// CountActiveAdmins locks the admins it counts in a Postgres transaction,
+// so two transactions can't each remove a different one of the last two.
+// SQLite transactions are serializable, so there it needs no lock.
+func (s *sqlUserStore) CountActiveAdmins(exceptID int) (int, error) {
+	if s.tx == nil || s.db.dialect != dialectPostgres {
+		var count int
+		err := s.q().QueryRow(`
+			SELECT COUNT(*) FROM users WHERE is_admin = TRUE AND is_disabled = FALSE AND id != ?
+		`, exceptID).Scan(&count)
+		return count, err
+	}
+
+	// Postgres can't lock the rows behind an aggregate, so they are
+	// selected and counted here
+	rows, err := s.tx.Query(`
+		SELECT id FROM users WHERE is_admin = TRUE AND is_disabled = FALSE AND id != ? FOR UPDATE
+	`, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	return count, rows.Err()
+}
+
+func (s *sqlUserStore) CompleteSetup(setupTokenHash, passwordHash string) error {
+	result, err := s.q().Exec(`
+		UPDATE users
+		SET password = ?, is_setup = TRUE, setup_token_hash = NULL, setup_token_expiry = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE setup_token_hash = ? AND setup_token_expiry > ?
+	`, passwordHash, setupTokenHash, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to update user password: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check affected rows: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrInvalidSetupToken
+	}
+	return nil
+}
+
+func (s *sqlUserStore) MarkSetup(id int) error {
+	return s.update(id, "mark user setup", `is_setup = TRUE, setup_token_hash = NULL, setup_token_expiry = NULL`)
+}
+
+func (s *sqlUserStore) SetSetupToken(id int, hash string, expiry time.Time) error {
+	return s.update(id, "update setup token", `setup_token_hash = ?, setup_token_expiry = ?`, hash, expiry)
+}
+
+func (s *sqlUserStore) SetPassword(id int, passwordHash string) error {
+	return s.update(id, "update user password", `password = ?`, passwordHash)
+}
+
+func (s *sqlUserStore) SetAdmin(id int, isAdmin bool) error {
+	return s.update(id, "update user role", `is_admin = ?`, isAdmin)
+}
+
+func (s *sqlUserStore) SetDisabled(id int, disabled bool) error {
+	return s.update(id, "update user status", `is_disabled = ?`, disabled)
+}
+
+func (s *sqlUserStore) SetEmail(id int, email string) error {
+	return s.update(id, "update email", `email = ?`, email)
+}
+
+func (s *sqlUserStore) SetProfile(id int, profile Profile) error {
+	return s.update(id, "update profile", `name = ?, preferred_name = ?, student_number = ?, pronouns = ?`,
+		profile.Name, profile.PreferredName, profile.StudentNumber, profile.Pronouns)
+}
+
+func (s *sqlUserStore) SetRosterInfo(id int, name, studentNumber, section string) error {
+	return s.update(id, "update roster info", `name = ?, student_number = ?, section = ?`, name, studentNumber, section)
+}
+
+// update sets columns of one user and bumps updated_at. what describes the
+// change for the error message.
+func (s *sqlUserStore) update(id int, what, set string, args ...any) error {
+	_, err := s.q().Exec(`UPDATE users SET `+set+`, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, append(args, id)...)
+	if err != nil {
+		return fmt.Errorf("failed to %s: %w", what, err)
+	}
+	return nil
+}
+
+func (s *sqlUserStore) DeleteUser(id int) error {
+	tx := s.tx
+	if tx == nil {
+		var err error
+		if tx, err = s.db.Begin(); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	// SQLite only honours ON DELETE CASCADE with foreign keys enabled, so
+	// dependent rows are removed explicitly
+	for _, table := range []string{"user_totp", "totp_recovery_codes", "login_tokens", "api_tokens", "user_roles"} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id = ?", table), id); err != nil {
+			return fmt.Errorf("failed to delete from %s: %w", table, err)
+		}
+	}
+	result, err := tx.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+
+	if s.tx != nil {
+		return nil // the caller commits
+	}
+	return tx.Commit()
+}
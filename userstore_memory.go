@@ -0,0 +1,244 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryUserStore keeps users in memory, for tests that need an AuthManager
+// without a database. It holds users only; features with tables of their
+// own, such as roles and API tokens, still need a DB.
+type memoryUserStore struct {
+	mu     sync.Mutex
+	users  map[int]*memoryUser
+	nextID int
+}
+
+type memoryUser struct {
+	User
+	setupTokenHash string
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{users: make(map[int]*memoryUser), nextID: 1}
+}
+
+// get returns a copy, so callers can't change stored users behind the
+// store's back
+func (s *memoryUserStore) get(match func(*memoryUser) bool) *User {
+	for _, u := range s.users {
+		if match(u) {
+			user := u.User
+			return &user
+		}
+	}
+	return nil
+}
+
+func (s *memoryUserStore) CreateUser(user *User, setupTokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == user.Email {
+			return fmt.Errorf("failed to create user: email %s is already used", user.Email)
+		}
+	}
+
+	now := time.Now()
+	user.ID = s.nextID
+	s.nextID++
+	stored := &memoryUser{User: *user, setupTokenHash: setupTokenHash}
+	stored.SetupToken = ""
+	stored.CreatedAt, stored.UpdatedAt = now, now
+	if setupTokenHash == "" {
+		stored.SetupTokenExpiry = time.Time{}
+	}
+	s.users[user.ID] = stored
+	return nil
+}
+
+func (s *memoryUserStore) GetUserByID(id int) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(func(u *memoryUser) bool { return u.ID == id }), nil
+}
+
+// GetUserByEmail ignores case, preferring an exact match and then the
+// oldest account, in the same order as the SQL store
+func (s *memoryUserStore) GetUserByEmail(email string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exact := func(u *memoryUser) bool { return u.Email == email }
+	var found *memoryUser
+	for _, u := range s.users {
+		if !strings.EqualFold(u.Email, email) {
+			continue
+		}
+		if found == nil || exact(u) && !exact(found) || exact(u) == exact(found) && u.ID < found.ID {
+			found = u
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	user := found.User
+	return &user, nil
+}
+
+func (s *memoryUserStore) GetUserBySetupTokenHash(hash string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(func(u *memoryUser) bool {
+		return u.setupTokenHash != "" && time.Now().Before(u.SetupTokenExpiry) &&
+			u.setupTokenHash == hash
+	}), nil
+}
+
+func (s *memoryUserStore) GetAllUsers() ([]*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []*User
+	for _, u := range s.users {
+		user := u.User
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID > users[j].ID })
+	return users, nil
+}
+
+func (s *memoryUserStore) CountUsers() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users), nil
+}
+
+func (s *memoryUserStore) CountActiveAdmins(exceptID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, u := range s.users {
+		if u.IsAdmin && !u.Disabled && u.ID != exceptID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryUserStore) CompleteSetup(setupTokenHash, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.setupTokenHash != "" && u.setupTokenHash == setupTokenHash && time.Now().Before(u.SetupTokenExpiry) {
+			u.Password = passwordHash
+			u.IsSetup = true
+			u.setupTokenHash, u.SetupTokenExpiry = "", time.Time{}
+			u.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrInvalidSetupToken
+}
+
+// update applies change to one user. Like an SQL UPDATE, it's not an error
+// if there is no such user.
+func (s *memoryUserStore) update(id int, change func(*memoryUser)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[id]; ok {
+		change(u)
+		u.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (s *memoryUserStore) MarkSetup(id int) error {
+	return s.update(id, func(u *memoryUser) {
+		u.IsSetup = true
+		u.setupTokenHash, u.SetupTokenExpiry = "", time.Time{}
+	})
+}
+
+func (s *memoryUserStore) SetSetupToken(id int, hash string, expiry time.Time) error {
+	return s.update(id, func(u *memoryUser) { u.setupTokenHash, u.SetupTokenExpiry = hash, expiry })
+}
+
+func (s *memoryUserStore) SetPassword(id int, passwordHash string) error {
+	return s.update(id, func(u *memoryUser) { u.Password = passwordHash })
+}
+
+func (s *memoryUserStore) SetAdmin(id int, isAdmin bool) error {
+	return s.update(id, func(u *memoryUser) { u.IsAdmin = isAdmin })
+}
+
+func (s *memoryUserStore) SetDisabled(id int, disabled bool) error {
+	return s.update(id, func(u *memoryUser) { u.Disabled = disabled })
+}
+
+func (s *memoryUserStore) SetEmail(id int, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == email && u.ID != id {
+			return fmt.Errorf("failed to update email: email %s is already used", email)
+		}
+	}
+	if u, ok := s.users[id]; ok {
+		u.Email = email
+		u.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (s *memoryUserStore) SetProfile(id int, profile Profile) error {
+	return s.update(id, func(u *memoryUser) {
+		u.Name, u.PreferredName = profile.Name, profile.PreferredName
+		u.StudentNumber, u.Pronouns = profile.StudentNumber, profile.Pronouns
+	})
+}
+
+func (s *memoryUserStore) SetRosterInfo(id int, name, studentNumber, section string) error {
+	return s.update(id, func(u *memoryUser) { u.Name, u.StudentNumber, u.Section = name, studentNumber, section })
+}
+
+func (s *memoryUserStore) DeleteUser(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+	return nil
+}
+
+// WithTx returns a store working on a copy of the users, which replaces
+// them when tx commits and is dropped if it rolls back. Changes made outside
+// the transaction meanwhile are lost, so tests shouldn't make any.
+func (s *memoryUserStore) WithTx(tx *Tx) UserStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	staged := &memoryUserStore{users: make(map[int]*memoryUser, len(s.users)), nextID: s.nextID}
+	for id, u := range s.users {
+		user := *u
+		staged.users[id] = &user
+	}
+	tx.afterCommit(func() {
+		staged.mu.Lock()
+		defer staged.mu.Unlock()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.users, s.nextID = staged.users, staged.nextID
+	})
+	return staged
+}
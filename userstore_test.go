@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testUserStores runs test against each UserStore implementation, so the
+// in-memory store keeps behaving like the SQL one
+func testUserStores(t *testing.T, test func(t *testing.T, users UserStore)) {
+	t.Run("sql", func(t *testing.T) {
+		setupTest(t, ServerConfig{})
+		test(t, newSQLUserStore(authManager.db))
+	})
+	t.Run("memory", func(t *testing.T) {
+		setupTest(t, ServerConfig{}) // for transactions
+		test(t, newMemoryUserStore())
+	})
+}
+
+func storeUser(t *testing.T, users UserStore, email string, isAdmin bool, setupTokenHash string) *User {
+	user := &User{Email: email, IsAdmin: isAdmin, SetupTokenExpiry: time.Now().Add(time.Hour)}
+	if err := users.CreateUser(user, setupTokenHash); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestUserStoreGetUserByEmail(t *testing.T) {
+	testUserStores(t, func(t *testing.T, users UserStore) {
+		first := storeUser(t, users, "Sam@Example.edu", false, "")
+		second := storeUser(t, users, "sam@example.edu", false, "")
+
+		tests := []struct {
+			email  string
+			wantID int
+		}{
+			{"Sam@Example.edu", first.ID},
+			{"sam@example.edu", second.ID},
+			{"SAM@EXAMPLE.EDU", first.ID}, // no exact match, so the oldest
+			{"someone@example.edu", 0},
+		}
+		for _, tt := range tests {
+			user, err := users.GetUserByEmail(tt.email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotID := 0
+			if user != nil {
+				gotID = user.ID
+			}
+			if gotID != tt.wantID {
+				t.Errorf("GetUserByEmail(%q) = user %d, want %d", tt.email, gotID, tt.wantID)
+			}
+		}
+
+		if err := users.CreateUser(&User{Email: "sam@example.edu"}, ""); err == nil {
+			t.Error("created a second user with the same email")
+		}
+		if err := users.SetEmail(first.ID, "sam@example.edu"); err == nil {
+			t.Error("changed an email to one that is already used")
+		}
+	})
+}
+
+func TestUserStoreSetupToken(t *testing.T) {
+	testUserStores(t, func(t *testing.T, users UserStore) {
+		user := storeUser(t, users, "new@example.edu", false, "hash")
+		if found, err := users.GetUserBySetupTokenHash("hash"); err != nil || found == nil || found.ID != user.ID {
+			t.Fatalf("GetUserBySetupTokenHash = %v, %v; want user %d", found, err, user.ID)
+		}
+
+		if err := users.CompleteSetup("hash", "password hash"); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.CompleteSetup("hash", "another"); !errors.Is(err, ErrInvalidSetupToken) {
+			t.Errorf("reusing a setup token: got %v, want ErrInvalidSetupToken", err)
+		}
+		if found, _ := users.GetUserBySetupTokenHash("hash"); found != nil {
+			t.Error("a used setup token still finds its user")
+		}
+		found, err := users.GetUserByID(user.ID)
+		if err != nil || !found.IsSetup || found.Password != "password hash" {
+			t.Fatalf("after setup: %+v, %v", found, err)
+		}
+
+		if err := users.SetSetupToken(user.ID, "expired", time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if found, _ := users.GetUserBySetupTokenHash("expired"); found != nil {
+			t.Error("an expired setup token finds its user")
+		}
+		if err := users.CompleteSetup("expired", "another"); !errors.Is(err, ErrInvalidSetupToken) {
+			t.Errorf("using an expired setup token: got %v, want ErrInvalidSetupToken", err)
+		}
+	})
+}
+
+func TestUserStoreListsAndCounts(t *testing.T) {
+	testUserStores(t, func(t *testing.T, users UserStore) {
+		admin := storeUser(t, users, "admin@example.edu", true, "")
+		other := storeUser(t, users, "other@example.edu", true, "")
+		student := storeUser(t, users, "student@example.edu", false, "")
+
+		all, err := users.GetAllUsers()
+		if err != nil || len(all) != 3 || all[0].ID != student.ID || all[2].ID != admin.ID {
+			t.Errorf("GetAllUsers isn't newest first: %v, %v", all, err)
+		}
+		if err := users.SetDisabled(other.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := users.CountActiveAdmins(0); err != nil || n != 1 {
+			t.Errorf("CountActiveAdmins(0) = %d, %v; want 1", n, err)
+		}
+		if n, err := users.CountActiveAdmins(admin.ID); err != nil || n != 0 {
+			t.Errorf("CountActiveAdmins(admin) = %d, %v; want 0", n, err)
+		}
+
+		if err := users.DeleteUser(student.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.DeleteUser(student.ID); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("deleting a deleted user: got %v, want ErrUserNotFound", err)
+		}
+		if n, err := users.CountUsers(); err != nil || n != 2 {
+			t.Errorf("CountUsers = %d, %v; want 2", n, err)
+		}
+	})
+}
+
+func TestUserStoreWithTx(t *testing.T) {
+	testUserStores(t, func(t *testing.T, users UserStore) {
+		user := storeUser(t, users, "student@example.edu", false, "")
+
+		for _, commit := range []bool{false, true} {
+			tx, err := authManager.db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			inTx := users.WithTx(tx)
+			if err := inTx.SetRosterInfo(user.ID, "Sam", "100", "A1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := inTx.DeleteUser(user.ID); err != nil {
+				t.Fatal(err)
+			}
+			if commit {
+				err = tx.Commit()
+			} else {
+				err = tx.Rollback()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found, err := users.GetUserByID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commit && found != nil {
+				t.Error("a committed delete didn't take effect")
+			}
+			if !commit && (found == nil || found.Name != "") {
+				t.Errorf("changes survived a rollback: %+v", found)
+			}
+		}
+	})
+}